@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ?db=all 时查询全部数据库，配置ID不能使用这个值
+const allDatabases = "all"
+
+// userStatsFilter bucket搜索的过滤条件，全部为空时为用户总览
+type userStatsFilter struct {
+	BID      string
+	BName    string
+	Username string
+	Limit    int
+}
+
+// DBUserStats 单个数据库的查询结果，失败时只记录错误
+type DBUserStats struct {
+	DB         string      `json:"db"`
+	Users      []UserStats `json:"users"`
+	TotalUsers int         `json:"total_users"`
+	TotalFiles uint64      `json:"total_files"`
+	TotalSize  float64     `json:"total_size_mb"`
+	Elapsed    string      `json:"elapsed"`
+	Error      string      `json:"error,omitempty"`
+	Route      *ReadRoute  `json:"read_route,omitempty"`
+	Cache      *CacheInfo  `json:"cache,omitempty"`
+}
+
+// UserSource 合并后的用户在某个数据库中的数据
+type UserSource struct {
+	DB    string  `json:"db"`
+	ID    uint64  `json:"id"`
+	Files uint64  `json:"files"`
+	Size  float64 `json:"size_mb"`
+}
+
+// MergedUser 按用户名合并多个数据库中的同名用户
+type MergedUser struct {
+	Username   string       `json:"username"`
+	TotalFiles uint64       `json:"total_files"`
+	TotalSize  float64      `json:"total_size_mb"`
+	Sources    []UserSource `json:"sources"`
+}
+
+// AllUserStats 多个数据库的汇总结果
+type AllUserStats struct {
+	Merge      bool          `json:"merge"`
+	Databases  []DBUserStats `json:"databases"`
+	Merged     []MergedUser  `json:"merged,omitempty"`
+	TotalUsers int           `json:"total_users"` // 合并时为不同用户名的数量
+	TotalFiles uint64        `json:"total_files"`
+	TotalSize  float64       `json:"total_size_mb"`
+	Failed     int           `json:"failed"`
+}
+
+// collectUserStats 并发查询ids中的每个数据库，单个数据库失败不影响其他数据库
+func collectUserStats(ctx context.Context, ids []string, f userStatsFilter, merge, refresh bool) *AllUserStats {
+	result := &AllUserStats{Merge: merge, Databases: make([]DBUserStats, len(ids))}
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			start := time.Now()
+			s := DBUserStats{DB: id}
+			defer func() {
+				s.Elapsed = time.Since(start).String()
+				result.Databases[i] = s
+			}()
+
+			users, route, cache, err := cachedUserStats(ctx, id, f, refresh)
+			if err != nil {
+				s.Error = err.Error()
+				return
+			}
+			s.Route, s.Cache = &route, &cache
+			s.Users = users
+			s.TotalUsers = len(users)
+			for _, u := range users {
+				s.TotalFiles += u.TotalFiles
+				s.TotalSize += u.TotalSize
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	merged := make(map[string]*MergedUser)
+	for _, s := range result.Databases {
+		if s.Error != "" {
+			slog.WarnContext(ctx, "User stats for database failed", "db", s.DB, "err", s.Error)
+			result.Failed++
+			continue
+		}
+		result.TotalUsers += s.TotalUsers
+		result.TotalFiles += s.TotalFiles
+		result.TotalSize += s.TotalSize
+		if !merge {
+			continue
+		}
+		for _, u := range s.Users {
+			m := merged[u.Username]
+			if m == nil {
+				m = &MergedUser{Username: u.Username}
+				merged[u.Username] = m
+			}
+			m.TotalFiles += u.TotalFiles
+			m.TotalSize += u.TotalSize
+			m.Sources = append(m.Sources, UserSource{DB: s.DB, ID: u.ID, Files: u.TotalFiles, Size: u.TotalSize})
+		}
+	}
+	if merge {
+		for _, m := range merged {
+			result.Merged = append(result.Merged, *m)
+		}
+		sort.Slice(result.Merged, func(i, j int) bool {
+			if result.Merged[i].TotalSize != result.Merged[j].TotalSize {
+				return result.Merged[i].TotalSize > result.Merged[j].TotalSize
+			}
+			return result.Merged[i].Username < result.Merged[j].Username
+		})
+		result.TotalUsers = len(result.Merged)
+	}
+	return result
+}
+
+// configIDs 返回全部数据库的ID
+func configIDs(cfg AppConfig) []string {
+	ids := make([]string, 0, len(cfg.Configs))
+	for _, c := range cfg.Configs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// userStatsFilterFromRequest type=bucket时读取bucket搜索的过滤条件
+func userStatsFilterFromRequest(r *http.Request) userStatsFilter {
+	q := r.URL.Query()
+	if q.Get("type") != "bucket" {
+		return userStatsFilter{}
+	}
+	f := userStatsFilter{BID: q.Get("bid"), BName: q.Get("bname"), Username: q.Get("username")}
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil {
+		f.Limit = l
+	}
+	return f
+}
+
+// allUserStatsHandler 用户统计页面的全部数据库模式，merge=none时按数据库分开显示
+func allUserStatsHandler(w http.ResponseWriter, r *http.Request, cfg AppConfig, startTime time.Time) {
+	filter := userStatsFilterFromRequest(r)
+	bucketSearch := r.URL.Query().Get("type") == "bucket"
+	merge := !bucketSearch && r.URL.Query().Get("merge") != "none"
+	stats := collectUserStats(r.Context(), configIDs(cfg), filter, merge, r.URL.Query().Get("refresh") == "1")
+
+	// bucket搜索结果按数据库分节，每节复用单库的模板
+	type section struct {
+		Users       []UserStats
+		SelectedDB  string
+		BID         string
+		BName       string
+		Username    string
+		Limit       int
+		Route       *ReadRoute
+		Cache       *CacheInfo
+		ElapsedTime string
+		Error       string
+	}
+	var sections []section
+	for _, s := range stats.Databases {
+		sections = append(sections, section{
+			Users:       s.Users,
+			SelectedDB:  s.DB,
+			BID:         filter.BID,
+			BName:       filter.BName,
+			Username:    filter.Username,
+			Limit:       filter.Limit,
+			Route:       s.Route,
+			Cache:       s.Cache,
+			ElapsedTime: s.Elapsed,
+			Error:       s.Error,
+		})
+	}
+	data := map[string]interface{}{
+		"Stats":       stats,
+		"Sections":    sections,
+		"Configs":     cfg.Configs,
+		"SelectedDB":  allDatabases,
+		"RefreshURL":  refreshURL(r),
+		"ElapsedTime": time.Since(startTime).String(),
+	}
+
+	content := "templates/user_stats_all_content.html"
+	if bucketSearch {
+		content = "templates/bucket_stats_all_content.html"
+	}
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		tmpl, err := template.ParseFS(templates, content, "templates/bucket_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.ExecuteTemplate(w, path.Base(content), data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	} else {
+		tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/user_stats.html", content, "templates/bucket_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// user_stats.html引用的内容模板替换为全部数据库的版本
+		if _, err := tmpl.AddParseTree("user_stats_content.html", tmpl.Lookup(path.Base(content)).Tree); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+	slog.DebugContext(r.Context(), "allUserStatsHandler completed", "elapsed", time.Since(startTime), "databases", len(stats.Databases), "failed", stats.Failed)
+}
+
+// userStatsAPIHandler 以JSON返回用户统计，db=all时汇总全部数据库
+func userStatsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := getAppConfig()
+	var ids []string
+	if r.URL.Query().Get("db") == allDatabases {
+		ids = configIDs(cfg)
+	} else {
+		dbID, ok := selectDBConfig(w, r, cfg)
+		if !ok {
+			return
+		}
+		ids = []string{dbID}
+	}
+	stats := collectUserStats(r.Context(), ids, userStatsFilterFromRequest(r), r.URL.Query().Get("merge") != "none", r.URL.Query().Get("refresh") == "1")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 各统计页面结果的默认缓存时间，可通过配置cache_ttl按页面覆盖，0表示不缓存
+var defaultCacheTTL = map[string]time.Duration{
+	"user_stats": time.Minute,
+	"partitions": 5 * time.Minute,
+	"histogram":  5 * time.Minute,
+	"extensions": 5 * time.Minute,
+	"ingestion":  2 * time.Minute,
+	"forecast":   10 * time.Minute,
+}
+
+// 缓存条目上限，超过时先清理过期条目，再淘汰最早的条目
+const maxCacheEntries = 500
+
+type cacheEntry struct {
+	value    interface{}
+	storedAt time.Time
+	expires  time.Time
+}
+
+// cacheCall 正在执行的查询，相同的请求等待它完成并共享结果
+type cacheCall struct {
+	done  chan struct{}
+	value interface{}
+	at    time.Time
+	err   error
+}
+
+// QueryCache 进程内的查询结果缓存，键为 页面+数据库+过滤条件
+type QueryCache struct {
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+	// 每次Invalidate加一，查询期间发生过失效时结果不写入缓存
+	gen uint64
+
+	hits, misses, shared uint64
+}
+
+func NewQueryCache() *QueryCache {
+	return &QueryCache{
+		entries:  make(map[string]*cacheEntry),
+		inflight: make(map[string]*cacheCall),
+	}
+}
+
+var queryCache = NewQueryCache()
+
+var errQueryAborted = errors.New("query aborted")
+
+// CacheInfo 页面上显示的缓存状态
+type CacheInfo struct {
+	Hit        bool          `json:"hit"`
+	StoredAt   time.Time     `json:"stored_at"`
+	TTL        time.Duration `json:"-"`
+	RefreshURL string        `json:"-"`
+}
+
+// AgeSeconds 结果缓存了多少秒
+func (c CacheInfo) AgeSeconds() int {
+	return int(time.Since(c.StoredAt).Seconds())
+}
+
+// SetHeaders 在API响应中标明是否命中缓存
+func (c CacheInfo) SetHeaders(w http.ResponseWriter) {
+	if c.Hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	w.Header().Set("Age", strconv.Itoa(c.AgeSeconds()))
+}
+
+// Do 返回key对应的缓存结果，没有缓存、已过期或refresh为true时执行fn。
+// 相同key的并发请求只执行一次fn。出错的结果不缓存。
+func (c *QueryCache) Do(key string, ttl time.Duration, refresh bool, fn func() (interface{}, error)) (interface{}, CacheInfo, error) {
+	info := CacheInfo{TTL: ttl}
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && !refresh && time.Now().Before(e.expires) {
+		c.hits++
+		c.mu.Unlock()
+		info.Hit, info.StoredAt = true, e.storedAt
+		return e.value, info, nil
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.shared++
+		c.mu.Unlock()
+		<-call.done
+		info.StoredAt = call.at
+		return call.value, info, call.err
+	}
+	c.misses++
+	call := &cacheCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	gen := c.gen
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		// 失效后可能已有新的查询登记在同一个key下
+		if c.inflight[key] == call {
+			delete(c.inflight, key)
+		}
+		if call.err == nil && ttl > 0 && c.gen == gen {
+			c.entries[key] = &cacheEntry{value: call.value, storedAt: call.at, expires: call.at.Add(ttl)}
+			c.evictLocked()
+		}
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	// fn panic时等待的请求得到错误
+	call.err = errQueryAborted
+	call.value, call.err = fn()
+	call.at = time.Now()
+
+	info.StoredAt = call.at
+	return call.value, info, call.err
+}
+
+// evictLocked 条目超过上限时清理，调用时必须持有锁
+func (c *QueryCache) evictLocked() {
+	if len(c.entries) <= maxCacheEntries {
+		return
+	}
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for len(c.entries) > maxCacheEntries {
+		var oldest string
+		var oldestAt time.Time
+		for k, e := range c.entries {
+			if oldest == "" || e.storedAt.Before(oldestAt) {
+				oldest, oldestAt = k, e.storedAt
+			}
+		}
+		delete(c.entries, oldest)
+	}
+}
+
+// Invalidate 删除某个数据库的所有缓存，dbID为空时清空全部缓存
+func (c *QueryCache) Invalidate(dbID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	// 新的请求不再等待失效前开始的查询
+	for k := range c.inflight {
+		if dbID == "" || cacheKeyDB(k) == dbID {
+			delete(c.inflight, k)
+		}
+	}
+	n := 0
+	for k := range c.entries {
+		if dbID == "" || cacheKeyDB(k) == dbID {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// CacheStats 缓存的统计信息
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Shared  uint64 `json:"shared"` // 等待相同的查询完成的请求数
+}
+
+func (c *QueryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: len(c.entries), Hits: c.hits, Misses: c.misses, Shared: c.shared}
+}
+
+// cacheKey 由数据库、页面和影响查询结果的参数组成，Encode按参数名排序
+func cacheKey(dbID, view string, q url.Values, params ...string) string {
+	filters := url.Values{}
+	for _, p := range params {
+		if v := q.Get(p); v != "" {
+			filters.Set(p, v)
+		}
+	}
+	return dbID + "\x00" + view + "\x00" + filters.Encode()
+}
+
+func cacheKeyDB(key string) string {
+	dbID, _, _ := strings.Cut(key, "\x00")
+	return dbID
+}
+
+// cacheTTL 返回页面的缓存时间
+func cacheTTL(cfg AppConfig, view string) time.Duration {
+	if s, ok := cfg.CacheTTL[view]; ok {
+		return time.Duration(s) * time.Second
+	}
+	return defaultCacheTTL[view]
+}
+
+// refreshURL 当前页面加上refresh=1，用于跳过缓存重新查询
+func refreshURL(r *http.Request) string {
+	q := r.URL.Query()
+	q.Set("refresh", "1")
+	return r.URL.Path + "?" + q.Encode()
+}
+
+// cachedQuery 带缓存地执行xxxFromRequest，params为影响查询结果的URL参数，refresh=1时跳过缓存。
+// 共享其他请求的查询出错时状态码为500
+func cachedQuery[T any](r *http.Request, dbID, view string, params []string, fn func() (T, int, error)) (T, CacheInfo, int, error) {
+	status := http.StatusOK
+	key := cacheKey(dbID, view, r.URL.Query(), params...)
+	refresh := r.URL.Query().Get("refresh") == "1"
+	v, info, err := queryCache.Do(key, cacheTTL(getAppConfig(), view), refresh, func() (interface{}, error) {
+		v, s, err := fn()
+		status = s
+		return v, err
+	})
+	if err != nil {
+		var zero T
+		if status == http.StatusOK {
+			status = http.StatusInternalServerError
+		}
+		return zero, info, status, err
+	}
+	info.RefreshURL = refreshURL(r)
+	return v.(T), info, http.StatusOK, nil
+}
+
+// cachedUserStats 带缓存地查询单个数据库的用户统计
+func cachedUserStats(ctx context.Context, dbID string, f userStatsFilter, refresh bool) ([]UserStats, ReadRoute, CacheInfo, error) {
+	type result struct {
+		users []UserStats
+		route ReadRoute
+	}
+	q := url.Values{}
+	q.Set("bid", f.BID)
+	q.Set("bname", f.BName)
+	q.Set("username", f.Username)
+	q.Set("limit", strconv.Itoa(f.Limit))
+	key := cacheKey(dbID, "user_stats", q, "bid", "bname", "username", "limit")
+
+	v, info, err := queryCache.Do(key, cacheTTL(getAppConfig(), "user_stats"), refresh, func() (interface{}, error) {
+		db, release, route, err := getReadDB(ctx, dbID)
+		if err != nil {
+			return nil, fmt.Errorf("database connection not available: %w", err)
+		}
+		defer release()
+		users, err := getUserStats(db, f.BID, f.BName, f.Username, f.Limit)
+		if err != nil {
+			return nil, err
+		}
+		return result{users, route}, nil
+	})
+	if err != nil {
+		return nil, ReadRoute{}, info, err
+	}
+	res := v.(result)
+	return res.users, res.route, info, nil
+}
+
+// cacheHandler POST清除缓存，db参数为空时清除全部
+func cacheHandler(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Handling cache request", "clientip", r.RemoteAddr, "method", r.Method)
+	if r.Method == http.MethodPost {
+		dbID := r.FormValue("db")
+		n := queryCache.Invalidate(dbID)
+		slog.InfoContext(r.Context(), "Invalidated cache entries", "db", dbID, "entries", n)
+		if r.Header.Get("Accept") != "application/json" {
+			http.Redirect(w, r, "/status", http.StatusSeeOther)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(queryCache.Stats())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheDo(t *testing.T) {
+	c := NewQueryCache()
+	calls := 0
+	fn := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	v, info, err := c.Do("k", time.Minute, false, fn)
+	if err != nil || v != 1 || info.Hit {
+		t.Fatalf("first call: %v %+v %v", v, info, err)
+	}
+	v, info, err = c.Do("k", time.Minute, false, fn)
+	if err != nil || v != 1 || !info.Hit {
+		t.Fatalf("second call should hit the cache: %v %+v %v", v, info, err)
+	}
+	v, info, _ = c.Do("k", time.Minute, true, fn)
+	if v != 2 || info.Hit {
+		t.Fatalf("refresh should run the query again: %v %+v", v, info)
+	}
+	v, _, _ = c.Do("k", time.Minute, false, fn)
+	if v != 2 {
+		t.Fatalf("refreshed result should be cached, got %v", v)
+	}
+
+	if s := c.Stats(); s.Entries != 1 || s.Hits != 2 || s.Misses != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestQueryCacheDoNoTTL(t *testing.T) {
+	c := NewQueryCache()
+	calls := 0
+	for i := 0; i < 3; i++ {
+		c.Do("k", 0, false, func() (interface{}, error) {
+			calls++
+			return nil, nil
+		})
+	}
+	if calls != 3 || c.Stats().Entries != 0 {
+		t.Errorf("ttl 0 should not cache: %d calls, %d entries", calls, c.Stats().Entries)
+	}
+}
+
+func TestQueryCacheDoExpired(t *testing.T) {
+	c := NewQueryCache()
+	c.Do("k", time.Millisecond, false, func() (interface{}, error) { return 1, nil })
+	time.Sleep(5 * time.Millisecond)
+	v, info, _ := c.Do("k", time.Millisecond, false, func() (interface{}, error) { return 2, nil })
+	if v != 2 || info.Hit {
+		t.Errorf("expired entry should be refreshed, got %v %+v", v, info)
+	}
+}
+
+func TestQueryCacheDoError(t *testing.T) {
+	c := NewQueryCache()
+	boom := errors.New("boom")
+	if _, _, err := c.Do("k", time.Minute, false, func() (interface{}, error) { return nil, boom }); err != boom {
+		t.Fatalf("err = %v", err)
+	}
+	v, _, err := c.Do("k", time.Minute, false, func() (interface{}, error) { return 1, nil })
+	if err != nil || v != 1 {
+		t.Errorf("errors must not be cached: %v %v", v, err)
+	}
+}
+
+func TestQueryCacheDoSingleflight(t *testing.T) {
+	c := NewQueryCache()
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	const waiters = 10
+	var wg sync.WaitGroup
+	results := make([]interface{}, waiters+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _, _ = c.Do("k", time.Minute, false, func() (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			close(started)
+			<-release
+			return "result", nil
+		})
+	}()
+	<-started
+	for i := 1; i <= waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = c.Do("k", time.Minute, false, func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				return "duplicate", nil
+			})
+		}(i)
+	}
+	// 等待所有请求都在等同一个查询
+	for c.Stats().Shared < waiters {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("query ran %d times, want 1", calls)
+	}
+	for i, r := range results {
+		if r != "result" {
+			t.Errorf("request %d got %v", i, r)
+		}
+	}
+}
+
+func TestQueryCacheDoPanic(t *testing.T) {
+	c := NewQueryCache()
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		defer func() { recover() }()
+		c.Do("k", time.Minute, false, func() (interface{}, error) {
+			close(started)
+			for c.Stats().Shared < 1 {
+				time.Sleep(time.Millisecond)
+			}
+			panic("query failed")
+		})
+	}()
+	<-started
+	go func() {
+		_, _, err := c.Do("k", time.Minute, false, func() (interface{}, error) { return nil, nil })
+		done <- err
+	}()
+	if err := <-done; err != errQueryAborted {
+		t.Errorf("waiter got %v, want %v", err, errQueryAborted)
+	}
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	c := NewQueryCache()
+	for i := 0; i < maxCacheEntries+20; i++ {
+		c.Do(fmt.Sprint(i), time.Hour, false, func() (interface{}, error) { return i, nil })
+	}
+	if n := c.Stats().Entries; n != maxCacheEntries {
+		t.Errorf("got %d entries, want %d", n, maxCacheEntries)
+	}
+}
+
+func TestQueryCacheInvalidate(t *testing.T) {
+	c := NewQueryCache()
+	q := url.Values{"bid": {"1"}}
+	for _, key := range []string{
+		cacheKey("a", "histogram", q, "bid"),
+		cacheKey("a", "partitions", q),
+		cacheKey("b", "histogram", q, "bid"),
+	} {
+		c.Do(key, time.Hour, false, func() (interface{}, error) { return 1, nil })
+	}
+	if n := c.Invalidate("a"); n != 2 {
+		t.Errorf("invalidated %d entries for a, want 2", n)
+	}
+	if n := c.Invalidate(""); n != 1 {
+		t.Errorf("invalidated %d remaining entries, want 1", n)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	q1 := url.Values{"bid": {"1"}, "part": {"0a"}, "refresh": {"1"}}
+	q2 := url.Values{"part": {"0a"}, "bid": {"1"}}
+	if cacheKey("a", "histogram", q1, "part", "bid") != cacheKey("a", "histogram", q2, "bid", "part") {
+		t.Error("keys should not depend on parameter order or unrelated parameters")
+	}
+	if cacheKey("a", "histogram", q1, "bid") == cacheKey("b", "histogram", q1, "bid") {
+		t.Error("keys of different databases must differ")
+	}
+	if got := cacheKeyDB(cacheKey("db-1", "histogram", q1, "bid")); got != "db-1" {
+		t.Errorf("cacheKeyDB = %q", got)
+	}
+}
+
+func TestQueryCacheInvalidateDuringCall(t *testing.T) {
+	c := NewQueryCache()
+	key := cacheKey("a", "histogram", url.Values{}, "bid")
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Do(key, time.Hour, false, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "stale", nil
+		})
+	}()
+	<-started
+	c.Invalidate("a")
+
+	// 失效后的请求不共享旧的查询
+	v, info, _ := c.Do(key, time.Hour, false, func() (interface{}, error) { return "fresh", nil })
+	if v != "fresh" || info.Hit {
+		t.Fatalf("request after invalidate got %v %+v", v, info)
+	}
+	close(release)
+	<-done
+
+	// 失效前开始的查询结果不能写入缓存
+	v, _, _ = c.Do(key, time.Hour, false, func() (interface{}, error) { return "again", nil })
+	if v == "stale" {
+		t.Error("result of a query started before Invalidate was cached")
+	}
+}
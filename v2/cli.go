@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+// 命令行子命令，不启动web服务，直接输出结果后退出
+var commands = map[string]func(args []string) int{
+	"integrity": integrityCommand,
+	"users":     queryCommand("users", "username"),
+	"buckets":   queryCommand("buckets", "bid", "bname", "username", "limit"),
+	"files":     queryCommand("files", "user", "part", "fid", "fname", "bucket", "limit"),
+}
+
+// 查询子命令的输出格式
+var commandFormats = map[string]func(w io.Writer) exportWriter{
+	"table": newTableExportWriter,
+	"json":  newJSONExportWriter,
+	"csv":   newCSVExportWriter,
+}
+
+// 查询子命令参数的说明
+var commandFilterUsage = map[string]string{
+	"username": "filter by username",
+	"bid":      "filter by bucket ID",
+	"bname":    "filter by bucket name",
+	"limit":    "max number of rows, 0 for no limit",
+	"user":     "user ID (required)",
+	"part":     "partition 00~ff (required)",
+	"fid":      "filter by file ID",
+	"fname":    "filter by filename (fuzzy match)",
+	"bucket":   "filter by bucket ID",
+}
+
+// runCommand 执行子命令并返回进程退出码
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		return 2
+	}
+	return cmd(args)
+}
+
+// openCommandDB 加载配置并获取指定ID(为空时使用默认库)的数据库连接
+func openCommandDB(dbID string) (*DB, string, func(), error) {
+	if err := loadConfig(); err != nil {
+		return nil, "", nil, err
+	}
+	if err := applyConfig(appConfig); err != nil {
+		return nil, "", nil, err
+	}
+	if dbID == "" {
+		dbID = appConfig.DefaultDB
+	}
+	if _, ok := appConfig.findConfig(dbID); !ok {
+		return nil, "", nil, fmt.Errorf("unknown database %q", dbID)
+	}
+	db, release, err := dbManager.Get(withQueryOrigin(context.Background(), "cli"), dbID)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return db, dbID, func() {
+		release()
+		dbManager.Close()
+	}, nil
+}
+
+// queryCommand 返回与导出功能使用相同查询的子命令，filters为支持的过滤参数
+func queryCommand(view string, filters ...string) func(args []string) int {
+	return func(args []string) int {
+		fs := flag.NewFlagSet(view, flag.ExitOnError)
+		fs.StringVar(&configPath, "config", configPath, "config file path")
+		dbID := fs.String("db", "", "database id, default database when empty")
+		format := fs.String("format", "table", "output format: table, json or csv")
+		values := make(map[string]*string)
+		for _, name := range filters {
+			values[name] = fs.String(name, "", commandFilterUsage[name])
+		}
+		fs.Parse(args)
+
+		newWriter, ok := commandFormats[*format]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+			return 2
+		}
+		q := url.Values{}
+		for name, v := range values {
+			if *v != "" {
+				q.Set(name, *v)
+			}
+		}
+		v := exportViews[view]
+		query, queryArgs, err := v.query(q)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+
+		db, _, closeDB, err := openCommandDB(*dbID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer closeDB()
+
+		rows, err := db.Query(query, queryArgs...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer rows.Close()
+
+		ew := newWriter(os.Stdout)
+		if _, err := writeExportRows(db, v, rows, ew, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err := ew.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		return 0
+	}
+}
+
+// tableExportWriter 对齐的文本表格，关闭时统一输出
+type tableExportWriter struct {
+	w *tabwriter.Writer
+}
+
+func newTableExportWriter(w io.Writer) exportWriter {
+	return &tableExportWriter{w: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+}
+
+func (t *tableExportWriter) WriteHeader(columns []string) error {
+	values := make([]interface{}, len(columns))
+	for i, c := range columns {
+		values[i] = c
+	}
+	return t.WriteRow(values)
+}
+
+func (t *tableExportWriter) WriteRow(values []interface{}) error {
+	for i, v := range values {
+		sep := "\t"
+		if i == len(values)-1 {
+			sep = "\n"
+		}
+		if _, err := fmt.Fprintf(t.w, "%v%s", v, sep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tableExportWriter) Flush() error { return nil }
+
+func (t *tableExportWriter) Close() error {
+	return t.w.Flush()
+}
+
+// jsonExportWriter 输出一个JSON数组，每行一个对象
+type jsonExportWriter struct {
+	w       io.Writer
+	columns []string
+	n       int
+}
+
+func newJSONExportWriter(w io.Writer) exportWriter {
+	return &jsonExportWriter{w: w}
+}
+
+func (j *jsonExportWriter) WriteHeader(columns []string) error {
+	j.columns = columns
+	_, err := io.WriteString(j.w, "[")
+	return err
+}
+
+func (j *jsonExportWriter) WriteRow(values []interface{}) error {
+	buf, err := jsonRow(j.columns, values)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if j.n == 0 {
+		sep = "\n  "
+	}
+	j.n++
+	if _, err := io.WriteString(j.w, sep); err != nil {
+		return err
+	}
+	_, err = j.w.Write(buf)
+	return err
+}
+
+func (j *jsonExportWriter) Flush() error { return nil }
+
+func (j *jsonExportWriter) Close() error {
+	_, err := io.WriteString(j.w, "\n]\n")
+	return err
+}
+
+// integrityCommand 执行数据一致性检查，发现问题时退出码为1
+func integrityCommand(args []string) int {
+	fs := flag.NewFlagSet("integrity", flag.ExitOnError)
+	fs.StringVar(&configPath, "config", configPath, "config file path")
+	dbID := fs.String("db", "", "database id, default database when empty")
+	samples := fs.Int("samples", defaultIntegritySamples, "number of sample records per issue")
+	asJSON := fs.Bool("json", false, "print report as JSON")
+	fs.Parse(args)
+
+	db, selectedID, closeDB, err := openCommandDB(*dbID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer closeDB()
+
+	report, err := checkIntegrity(db, *samples)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	report.DB = selectedID
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printIntegrityReport(os.Stdout, report)
+	}
+	if report.IssueCount() > 0 || len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printIntegrityReport(w io.Writer, report *IntegrityReport) {
+	fmt.Fprintf(w, "Database:              %s\n", report.DB)
+	fmt.Fprintf(w, "Elapsed:               %s\n", report.Elapsed)
+	fmt.Fprintf(w, "Orphan files:          %d\n", report.OrphanFiles)
+	fmt.Fprintf(w, "Misplaced files:       %d\n", report.MisplacedFiles)
+	fmt.Fprintf(w, "Buckets missing user:  %d\n", report.BucketsMissingUser)
+	fmt.Fprintf(w, "Invalid bucket parts:  %d\n", report.InvalidBucketParts)
+	for _, issue := range report.Issues {
+		fmt.Fprintf(w, "\n[%s] part=%s count=%d\n", issue.Kind, issue.Part, issue.Count)
+		for _, s := range issue.Samples {
+			fmt.Fprintf(w, "  fid=%d fname=%q bid=%d bname=%q bucket_part=%s user=%d\n",
+				s.FID, s.FName, s.BID, s.BName, s.BucketPart, s.UserID)
+		}
+	}
+	for _, e := range report.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 快照保存目录，可通过 -snapshot-dir 参数指定
+var snapshotDir = "snapshots"
+
+// 每类差异在页面上最多显示的行数
+const maxCompareRows = 500
+
+// SnapshotCount 文件数和字节数
+type SnapshotCount struct {
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// SnapshotBucket bucket的信息和数据量
+type SnapshotBucket struct {
+	BName    string `json:"bname"`
+	Username string `json:"username"`
+	Part     string `json:"part"`
+	SnapshotCount
+}
+
+// Snapshot 某一时刻用户、bucket和分区的数据量，保存为JSON文件
+type Snapshot struct {
+	DB         string                    `json:"db"`
+	TakenAt    time.Time                 `json:"taken_at"`
+	Users      map[string]SnapshotCount  `json:"users"` // 按用户名
+	Buckets    map[uint64]SnapshotBucket `json:"buckets"`
+	Partitions map[string]SnapshotCount  `json:"partitions"`
+	Errors     []string                  `json:"errors,omitempty"`
+	// 快照数据来自主库还是从库
+	Route *ReadRoute `json:"read_route,omitempty"`
+}
+
+// takeSnapshot 统计数据库当前的数据量，bucket只统计与buckets.part一致的文件
+func takeSnapshot(db *DB, dbID string) (*Snapshot, error) {
+	s := &Snapshot{
+		DB:         dbID,
+		TakenAt:    time.Now(),
+		Users:      make(map[string]SnapshotCount),
+		Buckets:    make(map[uint64]SnapshotBucket),
+		Partitions: make(map[string]SnapshotCount),
+	}
+
+	loads, errs, err := getPartitionLoads(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range loads {
+		s.Partitions[l.Part] = SnapshotCount{Files: l.Rows, Bytes: l.Bytes}
+	}
+
+	usernames, err := getUsernames(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range usernames {
+		s.Users[name] = SnapshotCount{}
+	}
+
+	rows, err := db.Query("SELECT bid, bname, user, part FROM buckets")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			bid    uint64
+			userID uint64
+			b      SnapshotBucket
+		)
+		if err := rows.Scan(&bid, &b.BName, &userID, &b.Part); err != nil {
+			return nil, err
+		}
+		b.Username = usernames[userID]
+		s.Buckets[bid] = b
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	bucketLoads, bucketErrs := getBucketLoads(db)
+	for _, l := range bucketLoads {
+		b := s.Buckets[l.BID]
+		b.Files, b.Bytes = l.Rows, l.Bytes
+		s.Buckets[l.BID] = b
+		if name, ok := usernames[l.UserID]; ok {
+			u := s.Users[name]
+			u.Files += l.Rows
+			u.Bytes += l.Bytes
+			s.Users[name] = u
+		}
+	}
+	s.Errors = append(errs, bucketErrs...)
+	return s, nil
+}
+
+// snapshotPath 快照名只允许字母、数字和'_', '.', '-'，防止访问目录以外的文件
+func snapshotPath(name string) (string, error) {
+	if !configIDPattern.MatchString(name) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return filepath.Join(snapshotDir, name+".json"), nil
+}
+
+// 同一秒内保存的快照名加序号区分，最多尝试的次数
+const maxSnapshotNameTries = 100
+
+// saveSnapshot 保存快照，返回快照名。名称为 <db>-YYYYMMDD-HHMMSS，已存在时加 -2、-3 等后缀
+func saveSnapshot(s *Snapshot) (string, error) {
+	if err := os.MkdirAll(snapshotDir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	// 先写临时文件再链接到最终文件名，避免读到写了一半的快照
+	f, err := os.CreateTemp(snapshotDir, ".snapshot-*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	base := fmt.Sprintf("%s-%s", s.DB, s.TakenAt.Format("20060102-150405"))
+	for i := 1; i <= maxSnapshotNameTries; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		path, err := snapshotPath(name)
+		if err != nil {
+			return "", err
+		}
+		// Link在目标已存在时失败，不会覆盖并发保存的同名快照
+		if err := os.Link(tmp, path); err == nil {
+			return name, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("too many snapshots named %s", base)
+}
+
+func loadSnapshot(name string) (*Snapshot, error) {
+	path, err := snapshotPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// listSnapshots 返回已保存的快照名，最新的在前
+func listSnapshots() ([]string, error) {
+	entries, err := os.ReadDir(snapshotDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// loadSource 加载对比的数据源，格式为 db:<配置ID> 或 snap:<快照名>，出错时返回HTTP状态码
+func loadSource(ctx context.Context, source string, cfg AppConfig) (*Snapshot, int, error) {
+	kind, name, ok := strings.Cut(source, ":")
+	if !ok || name == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid source %q, expected db:<id> or snap:<name>", source)
+	}
+	switch kind {
+	case "snap":
+		if _, err := snapshotPath(name); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		snap, err := loadSnapshot(name)
+		if os.IsNotExist(err) {
+			return nil, http.StatusBadRequest, fmt.Errorf("unknown snapshot %q", name)
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return snap, http.StatusOK, nil
+	case "db":
+		if _, ok := cfg.findConfig(name); !ok {
+			return nil, http.StatusBadRequest, fmt.Errorf("unknown database %q", name)
+		}
+		db, release, route, err := getReadDB(ctx, name)
+		if err != nil {
+			return nil, http.StatusBadGateway, fmt.Errorf("database connection not available: %w", err)
+		}
+		defer release()
+		snap, err := takeSnapshot(db, name)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		snap.Route = &route
+		return snap, http.StatusOK, nil
+	}
+	return nil, http.StatusBadRequest, fmt.Errorf("invalid source %q, expected db:<id> or snap:<name>", source)
+}
+
+// DiffRow 两个数据源中同一用户、bucket或分区的差异
+type DiffRow struct {
+	Key        string   `json:"key"`
+	Label      string   `json:"label,omitempty"`
+	Status     string   `json:"status"` // changed, only_left, only_right
+	LeftFiles  uint64   `json:"left_files"`
+	RightFiles uint64   `json:"right_files"`
+	LeftBytes  uint64   `json:"left_bytes"`
+	RightBytes uint64   `json:"right_bytes"`
+	FilesDelta int64    `json:"files_delta"`
+	BytesDelta int64    `json:"bytes_delta"`
+	FilesPct   *float64 `json:"files_pct,omitempty"` // 左侧为0时没有百分比
+	BytesPct   *float64 `json:"bytes_pct,omitempty"`
+}
+
+// FilesPctText 页面显示用的百分比
+func (d DiffRow) FilesPctText() string { return pctText(d.FilesPct) }
+
+func (d DiffRow) BytesPctText() string { return pctText(d.BytesPct) }
+
+func pctText(p *float64) string {
+	if p == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", *p)
+}
+
+// DiffSection 一类对象的差异
+type DiffSection struct {
+	Name      string    `json:"name"`
+	Compared  int       `json:"compared"`
+	Differing int       `json:"differing"`
+	Rows      []DiffRow `json:"rows"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// CompareResult 两个数据源的对比结果
+type CompareResult struct {
+	Left         string        `json:"left"`
+	Right        string        `json:"right"`
+	LeftTakenAt  time.Time     `json:"left_taken_at"`
+	RightTakenAt time.Time     `json:"right_taken_at"`
+	Sections     []DiffSection `json:"sections"`
+	Errors       []string      `json:"errors,omitempty"`
+	LeftRoute    *ReadRoute    `json:"left_read_route,omitempty"`
+	RightRoute   *ReadRoute    `json:"right_read_route,omitempty"`
+}
+
+// diffCounts 对比两个map，只返回文件数或大小不同的项，按字节差的绝对值排序
+func diffCounts(name string, left, right map[string]SnapshotCount, labels map[string]string) DiffSection {
+	sec := DiffSection{Name: name}
+	keys := make(map[string]bool)
+	for k := range left {
+		keys[k] = true
+	}
+	for k := range right {
+		keys[k] = true
+	}
+	sec.Compared = len(keys)
+
+	for k := range keys {
+		l, inLeft := left[k]
+		r, inRight := right[k]
+		if inLeft && inRight && l == r {
+			continue
+		}
+		row := DiffRow{
+			Key:        k,
+			Label:      labels[k],
+			Status:     "changed",
+			LeftFiles:  l.Files,
+			RightFiles: r.Files,
+			LeftBytes:  l.Bytes,
+			RightBytes: r.Bytes,
+			FilesDelta: int64(r.Files) - int64(l.Files),
+			BytesDelta: int64(r.Bytes) - int64(l.Bytes),
+			FilesPct:   deltaPct(l.Files, r.Files),
+			BytesPct:   deltaPct(l.Bytes, r.Bytes),
+		}
+		if !inLeft {
+			row.Status = "only_right"
+		} else if !inRight {
+			row.Status = "only_left"
+		}
+		sec.Rows = append(sec.Rows, row)
+	}
+	sec.Differing = len(sec.Rows)
+	sort.Slice(sec.Rows, func(i, j int) bool {
+		a, b := absInt64(sec.Rows[i].BytesDelta), absInt64(sec.Rows[j].BytesDelta)
+		if a != b {
+			return a > b
+		}
+		return sec.Rows[i].Key < sec.Rows[j].Key
+	})
+	if len(sec.Rows) > maxCompareRows {
+		sec.Rows = sec.Rows[:maxCompareRows]
+		sec.Truncated = true
+	}
+	return sec
+}
+
+func deltaPct(left, right uint64) *float64 {
+	if left == 0 {
+		return nil
+	}
+	p := (float64(right) - float64(left)) / float64(left) * 100
+	p = math.Round(p*100) / 100
+	return &p
+}
+
+func absInt64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// compareSnapshots 对比用户、bucket和分区
+func compareSnapshots(left, right *Snapshot) *CompareResult {
+	result := &CompareResult{
+		LeftTakenAt:  left.TakenAt,
+		RightTakenAt: right.TakenAt,
+		LeftRoute:    left.Route,
+		RightRoute:   right.Route,
+	}
+	result.Sections = append(result.Sections, diffCounts("users", left.Users, right.Users, nil))
+
+	bucketCounts := func(s *Snapshot, labels map[string]string) map[string]SnapshotCount {
+		m := make(map[string]SnapshotCount, len(s.Buckets))
+		for bid, b := range s.Buckets {
+			key := strconv.FormatUint(bid, 10)
+			m[key] = b.SnapshotCount
+			labels[key] = fmt.Sprintf("%s (%s, part %s)", b.BName, b.Username, b.Part)
+		}
+		return m
+	}
+	labels := make(map[string]string)
+	leftBuckets := bucketCounts(left, labels)
+	rightBuckets := bucketCounts(right, labels)
+	result.Sections = append(result.Sections, diffCounts("buckets", leftBuckets, rightBuckets, labels))
+	result.Sections = append(result.Sections, diffCounts("partitions", left.Partitions, right.Partitions, nil))
+
+	for _, e := range left.Errors {
+		result.Errors = append(result.Errors, "left: "+e)
+	}
+	for _, e := range right.Errors {
+		result.Errors = append(result.Errors, "right: "+e)
+	}
+	return result
+}
+
+// compareFromRequest 并发加载left和right两个数据源并对比
+func compareFromRequest(r *http.Request, cfg AppConfig) (*CompareResult, int, error) {
+	q := r.URL.Query()
+	sources := []string{q.Get("left"), q.Get("right")}
+	if sources[0] == "" || sources[1] == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("left and right are required")
+	}
+
+	snaps := make([]*Snapshot, 2)
+	statuses := make([]int, 2)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src string) {
+			defer wg.Done()
+			snaps[i], statuses[i], errs[i] = loadSource(r.Context(), src, cfg)
+		}(i, src)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, statuses[i], fmt.Errorf("%s: %w", sources[i], err)
+		}
+	}
+
+	result := compareSnapshots(snaps[0], snaps[1])
+	result.Left, result.Right = sources[0], sources[1]
+	return result, http.StatusOK, nil
+}
+
+// compareHandler 对比页面，POST snapshot=<db> 保存数据库的快照
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling compare request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	if r.Method == http.MethodPost {
+		dbID := r.FormValue("snapshot")
+		if _, ok := cfg.findConfig(dbID); !ok {
+			http.Error(w, "Unknown database: "+dbID, http.StatusBadRequest)
+			return
+		}
+		db, release, route, err := getReadDB(r.Context(), dbID)
+		if err != nil {
+			http.Error(w, "Database connection not available: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer release()
+		snap, err := takeSnapshot(db, dbID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		snap.Route = &route
+		name, err := saveSnapshot(snap)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Saved snapshot", "name", name, "elapsed", time.Since(startTime))
+		http.Redirect(w, r, "/compare?left=snap:"+name, http.StatusSeeOther)
+		return
+	}
+
+	snapshots, err := listSnapshots()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	data := map[string]interface{}{
+		"Configs":   cfg.Configs,
+		"Snapshots": snapshots,
+		"Left":      q.Get("left"),
+		"Right":     q.Get("right"),
+	}
+	if q.Get("left") != "" && q.Get("right") != "" {
+		result, status, err := compareFromRequest(r, cfg)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		data["Result"] = result
+		data["ElapsedTime"] = time.Since(startTime).String()
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/compare.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "compareHandler completed", "elapsed", time.Since(startTime))
+}
+
+// compareAPIHandler 以JSON返回对比结果
+func compareAPIHandler(w http.ResponseWriter, r *http.Request) {
+	result, status, err := compareFromRequest(r, getAppConfig())
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeltaPct(t *testing.T) {
+	tests := []struct {
+		left, right uint64
+		want        string
+	}{
+		{0, 10, "-"},
+		{0, 0, "-"},
+		{100, 100, "+0.0%"},
+		{100, 150, "+50.0%"},
+		{200, 50, "-75.0%"},
+		{3, 4, "+33.3%"},
+		{1, 0, "-100.0%"},
+	}
+	for _, tt := range tests {
+		if got := pctText(deltaPct(tt.left, tt.right)); got != tt.want {
+			t.Errorf("deltaPct(%d, %d) = %s, want %s", tt.left, tt.right, got, tt.want)
+		}
+	}
+	if p := deltaPct(3, 4); *p != 33.33 {
+		t.Errorf("deltaPct(3, 4) = %v, want rounded to 33.33", *p)
+	}
+}
+
+func TestDiffCounts(t *testing.T) {
+	left := map[string]SnapshotCount{
+		"alice": {Files: 10, Bytes: 1000},
+		"bob":   {Files: 5, Bytes: 500},
+		"carol": {Files: 1, Bytes: 100},
+	}
+	right := map[string]SnapshotCount{
+		"alice": {Files: 10, Bytes: 1000},
+		"bob":   {Files: 6, Bytes: 300},
+		"dave":  {Files: 2, Bytes: 50},
+	}
+	sec := diffCounts("users", left, right, map[string]string{"bob": "Bob"})
+
+	if sec.Name != "users" || sec.Compared != 4 || sec.Differing != 3 || sec.Truncated {
+		t.Fatalf("got %+v", sec)
+	}
+	// 按字节差的绝对值排序: bob -200, carol -100, dave +50
+	want := []struct {
+		key, label, status     string
+		filesDelta, bytesDelta int64
+		bytesPct               string
+	}{
+		{"bob", "Bob", "changed", 1, -200, "-40.0%"},
+		{"carol", "", "only_left", -1, -100, "-100.0%"},
+		{"dave", "", "only_right", 2, 50, "-"},
+	}
+	if len(sec.Rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(sec.Rows), len(want))
+	}
+	for i, w := range want {
+		r := sec.Rows[i]
+		if r.Key != w.key || r.Label != w.label || r.Status != w.status ||
+			r.FilesDelta != w.filesDelta || r.BytesDelta != w.bytesDelta || r.BytesPctText() != w.bytesPct {
+			t.Errorf("row %d: got %+v, want %+v", i, r, w)
+		}
+	}
+}
+
+func TestDiffCountsTruncated(t *testing.T) {
+	left := make(map[string]SnapshotCount)
+	right := make(map[string]SnapshotCount)
+	for i := 0; i < maxCompareRows+10; i++ {
+		left[strconv.Itoa(i)] = SnapshotCount{Files: 1, Bytes: uint64(i)}
+	}
+	sec := diffCounts("buckets", left, right, nil)
+	if !sec.Truncated || len(sec.Rows) != maxCompareRows || sec.Differing != maxCompareRows+10 {
+		t.Fatalf("got %d rows of %d differing, truncated %v", len(sec.Rows), sec.Differing, sec.Truncated)
+	}
+	if sec.Rows[0].BytesDelta != -int64(maxCompareRows+9) {
+		t.Errorf("largest difference should come first, got %+v", sec.Rows[0])
+	}
+}
+
+func TestSaveSnapshotUniqueNames(t *testing.T) {
+	saved := snapshotDir
+	snapshotDir = t.TempDir()
+	defer func() { snapshotDir = saved }()
+
+	takenAt := time.Date(2026, 10, 19, 8, 30, 0, 0, time.Local)
+	var names []string
+	for i := 0; i < 3; i++ {
+		s := &Snapshot{DB: "main", TakenAt: takenAt, Partitions: map[string]SnapshotCount{"00": {Files: uint64(i)}}}
+		name, err := saveSnapshot(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	want := []string{"main-20261019-083000", "main-20261019-083000-2", "main-20261019-083000-3"}
+	for i, name := range names {
+		if name != want[i] {
+			t.Errorf("snapshot %d named %q, want %q", i, name, want[i])
+		}
+		s, err := loadSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Partitions["00"].Files != uint64(i) {
+			t.Errorf("snapshot %s holds the data of another save", name)
+		}
+	}
+	// 临时文件不能留在目录中
+	list, err := listSnapshots()
+	if err != nil || len(list) != 3 {
+		t.Errorf("listSnapshots = %v, %v", list, err)
+	}
+	if entries, _ := os.ReadDir(snapshotDir); len(entries) != 3 {
+		t.Errorf("%d files in snapshot dir, want 3", len(entries))
+	}
+}
+
+func TestLoadSourceStatus(t *testing.T) {
+	saved := snapshotDir
+	snapshotDir = t.TempDir()
+	defer func() { snapshotDir = saved }()
+	if err := os.WriteFile(filepath.Join(snapshotDir, "broken.json"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := validAppConfig()
+	tests := []struct {
+		source string
+		want   int
+	}{
+		{"main", http.StatusBadRequest},
+		{"file:main", http.StatusBadRequest},
+		{"db:missing", http.StatusBadRequest},
+		{"snap:../config", http.StatusBadRequest},
+		{"snap:missing", http.StatusBadRequest},
+		{"snap:broken", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if _, status, err := loadSource(context.Background(), tt.source, cfg); err == nil || status != tt.want {
+			t.Errorf("loadSource(%q) = %d, %v, want status %d", tt.source, status, err, tt.want)
+		}
+	}
+}
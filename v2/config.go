@@ -4,83 +4,343 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type Config struct {
+	// 唯一标识，URL中的?db=和默认库都使用ID引用，不受配置顺序影响
+	ID          string   `json:"id"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Host        string   `json:"host"`
+	Port        string   `json:"port"`
+	User        string   `json:"user"`
+	Password    string   `json:"password"`
+	DBName      string   `json:"dbname"`
+	// 只读从库，统计查询优先使用健康的从库
+	Replicas []Replica `json:"replicas,omitempty"`
+}
+
+// Replica 从库地址，User和Password为空时使用主库的
+type Replica struct {
 	Host     string `json:"host"`
 	Port     string `json:"port"`
-	User     string `json:"user"`
-	Password string `json:"password"`
-	DBName   string `json:"dbname"`
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 type AppConfig struct {
-	Configs        []Config `json:"configs"`
-	DefaultDBIndex int      `json:"default_db_index"`
+	Configs   []Config `json:"configs"`
+	DefaultDB string   `json:"default_db"`
+	// 旧版本按下标指定默认库，加载时迁移为DefaultDB
+	DefaultDBIndex *int `json:"default_db_index,omitempty"`
+	// 连接池空闲多少秒后关闭，0表示使用默认值
+	ConnIdleTimeout int `json:"conn_idle_timeout,omitempty"`
+	// 文件类型分类，分类名 -> 扩展名列表，为空时使用内置分类
+	ExtensionCategories map[string][]string `json:"extension_categories,omitempty"`
+	// 容量预测的目标大小(字节)，0表示使用默认值
+	UserCapacityBytes      uint64 `json:"user_capacity_bytes,omitempty"`
+	PartitionCapacityBytes uint64 `json:"partition_capacity_bytes,omitempty"`
+	// 从库延迟超过多少秒时不再使用，0表示使用默认值
+	MaxReplicaLag int `json:"max_replica_lag,omitempty"`
+	// 统计结果的缓存时间(秒)，页面名 -> 秒数，0表示不缓存，未设置的页面使用默认值
+	CacheTTL map[string]int `json:"cache_ttl,omitempty"`
+	// 查询超过多少毫秒时写入日志，0表示使用默认值
+	SlowQueryMs int `json:"slow_query_ms,omitempty"`
+	// 管理员令牌，用于查看查询的执行计划等操作，为空时禁用
+	AdminToken string `json:"admin_token,omitempty"`
+	// 日志级别：debug、info、warn、error，为空时为info
+	LogLevel string `json:"log_level,omitempty"`
+	// 定时报表及发送报表的SMTP服务器
+	SMTP    *SMTPConfig        `json:"smtp,omitempty"`
+	Reports []ReportDefinition `json:"reports,omitempty"`
+}
+
+var configIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// findConfig 按ID查找数据库配置
+func (c AppConfig) findConfig(id string) (Config, bool) {
+	for _, cfg := range c.Configs {
+		if cfg.ID == id {
+			return cfg, true
+		}
+	}
+	return Config{}, false
 }
 
+// sameConnection 判断两个配置是否指向同一个数据库连接
+func sameConnection(a, b Config) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.User == b.User &&
+		a.Password == b.Password && a.DBName == b.DBName
+}
+
+// 配置文件路径，可通过 -config 参数指定
+var configPath = "config.json"
+
+// configMu 保护 appConfig，热加载时整体替换
+var configMu sync.RWMutex
+
 func loadConfig() error {
 	// 先尝试读取配置文件
-	file, err := os.ReadFile("config.json")
+	file, err := os.ReadFile(configPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// 文件不存在时，使用并保存默认配置
 			appConfig = AppConfig{
 				Configs: []Config{{
+					ID:       "testdb",
 					Host:     "192.168.1.150",
 					Port:     "3306",
 					User:     "test",
 					Password: "test",
 					DBName:   "testdb",
 				}},
-				DefaultDBIndex: 0,
+				DefaultDB: "testdb",
 			}
-			if err = saveConfig(); err != nil {
-				log.Printf("Error saving default config: %v", err)
+			if err = saveConfig(appConfig); err != nil {
+				slog.Error("Error saving default config", "err", err)
 				return fmt.Errorf("failed to save default config: %w", err)
 			}
-			log.Println("Created default config file")
+			slog.Info("Created default config file", "path", configPath)
 			return nil
 		}
 		// 其他读取错误
-		log.Printf("Error reading config file: %v", err)
+		slog.Error("Error reading config file", "err", err)
 		return fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	// 文件存在，解析配置
-	if err := json.Unmarshal(file, &appConfig); err != nil {
-		log.Printf("Error parsing config file: %v", err)
-		return fmt.Errorf("failed to parse config file: %w", err)
+	cfg, migrated, err := parseConfig(file)
+	if err != nil {
+		slog.Error("Error parsing config file", "err", err)
+		return err
 	}
+	// 与热加载相同的校验，避免带着不完整的配置(如有报表但没有smtp)启动
+	if err := validateConfig(cfg); err != nil {
+		slog.Error("Invalid config file", "err", err)
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+	appConfig = cfg
 
-	// 确保DefaultDBIndex在有效范围内
-	if appConfig.DefaultDBIndex < 0 || appConfig.DefaultDBIndex >= len(appConfig.Configs) {
-		if len(appConfig.Configs) > 0 {
-			appConfig.DefaultDBIndex = 0
+	// 旧格式的配置文件迁移后写回
+	if migrated {
+		if err := saveConfig(cfg); err != nil {
+			slog.Error("Error saving migrated config", "err", err)
 		} else {
-			appConfig.DefaultDBIndex = -1 // No configs available
+			slog.Info("Migrated config file to named database IDs")
 		}
 	}
 
 	return nil
 }
 
-func saveConfig() error {
-	data, err := json.MarshalIndent(appConfig, "", "  ")
+// parseConfig 解析配置文件内容，补全缺失的ID并修正默认库，migrated表示是否从旧格式迁移
+func parseConfig(data []byte) (cfg AppConfig, migrated bool, err error) {
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, false, fmt.Errorf("failed to parse config file: %w", err)
+	}
+	migrated = migrateConfig(&cfg)
+	return cfg, migrated, nil
+}
+
+// migrateConfig 为没有ID的配置生成ID，并把旧的default_db_index转换为default_db。
+// 返回是否做了修改
+func migrateConfig(cfg *AppConfig) bool {
+	migrated := false
+	used := make(map[string]bool)
+	for _, c := range cfg.Configs {
+		if c.ID != "" {
+			used[c.ID] = true
+		}
+	}
+	configs := make([]Config, len(cfg.Configs))
+	copy(configs, cfg.Configs)
+	for i := range configs {
+		if configs[i].ID != "" {
+			continue
+		}
+		base := configIDFromName(configs[i].DBName, i)
+		id := base
+		for n := 2; used[id]; n++ {
+			id = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[id] = true
+		configs[i].ID = id
+		migrated = true
+	}
+	cfg.Configs = configs
+
+	if cfg.DefaultDBIndex != nil {
+		if cfg.DefaultDB == "" && *cfg.DefaultDBIndex >= 0 && *cfg.DefaultDBIndex < len(cfg.Configs) {
+			cfg.DefaultDB = cfg.Configs[*cfg.DefaultDBIndex].ID
+		}
+		cfg.DefaultDBIndex = nil
+		migrated = true
+	}
+
+	// 确保默认库存在
+	if _, ok := cfg.findConfig(cfg.DefaultDB); !ok {
+		if len(cfg.Configs) > 0 {
+			cfg.DefaultDB = cfg.Configs[0].ID
+		} else {
+			cfg.DefaultDB = "" // No configs available
+		}
+	}
+	return migrated
+}
+
+// configIDFromName 用库名生成ID，去掉不允许的字符
+func configIDFromName(name string, index int) string {
+	id := strings.Map(func(r rune) rune {
+		if r < 128 && configIDPattern.MatchString(string(r)) {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(name))
+	id = strings.Trim(id, "-")
+	if id == "" || id == allDatabases {
+		id = fmt.Sprintf("db%d", index)
+	}
+	return id
+}
+
+// validateConfig 检查配置是否完整，热加载时校验失败则继续使用旧配置
+func validateConfig(cfg AppConfig) error {
+	ids := make(map[string]bool)
+	for i, c := range cfg.Configs {
+		if !configIDPattern.MatchString(c.ID) {
+			return fmt.Errorf("config %d: invalid id %q, only letters, digits, '_', '.' and '-' are allowed", i, c.ID)
+		}
+		if ids[c.ID] {
+			return fmt.Errorf("config %d: duplicate id %q", i, c.ID)
+		}
+		if c.ID == allDatabases {
+			return fmt.Errorf("config %d: id %q is reserved", i, c.ID)
+		}
+		ids[c.ID] = true
+		if c.Host == "" {
+			return fmt.Errorf("config %s: host is empty", c.ID)
+		}
+		if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("config %s: invalid port %q", c.ID, c.Port)
+		}
+		if c.User == "" {
+			return fmt.Errorf("config %s: user is empty", c.ID)
+		}
+		if c.DBName == "" {
+			return fmt.Errorf("config %s: dbname is empty", c.ID)
+		}
+		for j, r := range c.Replicas {
+			if r.Host == "" {
+				return fmt.Errorf("config %s: replica %d host is empty", c.ID, j)
+			}
+			if port, err := strconv.Atoi(r.Port); err != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("config %s: replica %d invalid port %q", c.ID, j, r.Port)
+			}
+		}
+	}
+	extCategory := make(map[string]string)
+	for category, exts := range cfg.ExtensionCategories {
+		for _, ext := range exts {
+			ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+			if ext == "" {
+				return fmt.Errorf("extension_categories %s: empty extension", category)
+			}
+			if other, ok := extCategory[ext]; ok && other != category {
+				return fmt.Errorf("extension %q belongs to both %s and %s", ext, other, category)
+			}
+			extCategory[ext] = category
+		}
+	}
+	if cfg.MaxReplicaLag < 0 {
+		return fmt.Errorf("max_replica_lag %d must not be negative", cfg.MaxReplicaLag)
+	}
+	for view, ttl := range cfg.CacheTTL {
+		if _, ok := defaultCacheTTL[view]; !ok {
+			return fmt.Errorf("cache_ttl: unknown view %q", view)
+		}
+		if ttl < 0 {
+			return fmt.Errorf("cache_ttl %s: %d must not be negative", view, ttl)
+		}
+	}
+	if cfg.LogLevel != "" {
+		if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+	}
+	if cfg.SlowQueryMs < 0 {
+		return fmt.Errorf("slow_query_ms %d must not be negative", cfg.SlowQueryMs)
+	}
+	if cfg.ConnIdleTimeout < 0 {
+		return fmt.Errorf("conn_idle_timeout %d must not be negative", cfg.ConnIdleTimeout)
+	}
+	if len(cfg.Configs) > 0 && !ids[cfg.DefaultDB] {
+		return fmt.Errorf("default_db %q not found in configs", cfg.DefaultDB)
+	}
+	return validateReports(cfg, ids)
+}
+
+// saveConfig 先写临时文件再rename，避免监听方读到写了一半的文件
+func saveConfig(cfg AppConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), ".config-*.json")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("config.json", data, 0644)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// getAppConfig 返回当前配置的快照，Configs切片只会被整体替换，不会原地修改
+func getAppConfig() AppConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return appConfig
+}
+
+// applyConfig 替换当前配置，连接参数改变的连接池退役，在途请求继续使用旧连接池直到完成
+func applyConfig(cfg AppConfig) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	// 只在配置的log_level变化时重设，保留通过/debug/log-level临时修改的级别
+	if cfg.LogLevel != appConfig.LogLevel {
+		level, err := parseLogLevel(cfg.LogLevel)
+		if err != nil || cfg.LogLevel == "" {
+			level = slog.LevelInfo
+		}
+		logLevel.Set(level)
+	}
+	appConfig = cfg
+	// 连接的数据库可能已经改变
+	queryCache.Invalidate("")
+	return dbManager.Reload(cfg)
 }
 
 func connectDB(config Config) (*sql.DB, error) {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
 		config.User, config.Password, config.Host, config.Port, config.DBName)
-	log.Printf("dsn: %s\n", dsn)
 	return sql.Open("mysql", dsn)
 }
 
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// validAppConfig 能通过校验的最小配置
+func validAppConfig() AppConfig {
+	return AppConfig{
+		Configs: []Config{
+			{ID: "main", Host: "10.0.0.1", Port: "3306", User: "root", DBName: "files"},
+			{ID: "backup", Host: "10.0.0.2", Port: "3306", User: "root", DBName: "files"},
+		},
+		DefaultDB: "main",
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *AppConfig)
+		wantErr string
+	}{
+		{"valid", func(cfg *AppConfig) {}, ""},
+		{"no databases", func(cfg *AppConfig) { cfg.Configs, cfg.DefaultDB = nil, "" }, ""},
+		{"invalid id", func(cfg *AppConfig) { cfg.Configs[0].ID = "main db" }, "invalid id"},
+		{"duplicate id", func(cfg *AppConfig) { cfg.Configs[1].ID = "main" }, "duplicate id"},
+		{"reserved id", func(cfg *AppConfig) { cfg.Configs[1].ID = allDatabases }, "reserved"},
+		{"empty host", func(cfg *AppConfig) { cfg.Configs[0].Host = "" }, "host is empty"},
+		{"invalid port", func(cfg *AppConfig) { cfg.Configs[0].Port = "70000" }, "invalid port"},
+		{"empty user", func(cfg *AppConfig) { cfg.Configs[0].User = "" }, "user is empty"},
+		{"empty dbname", func(cfg *AppConfig) { cfg.Configs[0].DBName = "" }, "dbname is empty"},
+		{"replica", func(cfg *AppConfig) { cfg.Configs[0].Replicas = []Replica{{Host: "10.0.0.3", Port: "3306"}} }, ""},
+		{"replica without host", func(cfg *AppConfig) { cfg.Configs[0].Replicas = []Replica{{Port: "3306"}} }, "replica 0 host is empty"},
+		{"replica invalid port", func(cfg *AppConfig) { cfg.Configs[0].Replicas = []Replica{{Host: "10.0.0.3", Port: "x"}} }, "replica 0 invalid port"},
+		{"unknown default", func(cfg *AppConfig) { cfg.DefaultDB = "missing" }, "default_db"},
+		{
+			"extension in two categories",
+			func(cfg *AppConfig) {
+				cfg.ExtensionCategories = map[string][]string{"images": {"jpg"}, "photos": {".JPG"}}
+			},
+			"belongs to both",
+		},
+		{"empty extension", func(cfg *AppConfig) { cfg.ExtensionCategories = map[string][]string{"images": {"."}} }, "empty extension"},
+		{"negative replica lag", func(cfg *AppConfig) { cfg.MaxReplicaLag = -1 }, "max_replica_lag"},
+		{"unknown cache view", func(cfg *AppConfig) { cfg.CacheTTL = map[string]int{"nope": 10} }, "unknown view"},
+		{"negative cache ttl", func(cfg *AppConfig) { cfg.CacheTTL = map[string]int{"partitions": -1} }, "must not be negative"},
+		{"invalid log level", func(cfg *AppConfig) { cfg.LogLevel = "loud" }, "invalid log level"},
+		{"negative slow query threshold", func(cfg *AppConfig) { cfg.SlowQueryMs = -1 }, "slow_query_ms"},
+		{"negative idle timeout", func(cfg *AppConfig) { cfg.ConnIdleTimeout = -1 }, "conn_idle_timeout"},
+		{
+			"report without smtp",
+			func(cfg *AppConfig) {
+				cfg.Reports = []ReportDefinition{{Name: "daily", View: "users", Schedule: "daily 08:00", Recipients: []string{"a@example.com"}}}
+			},
+			"smtp host and from are required",
+		},
+		{
+			"report on unknown database",
+			func(cfg *AppConfig) {
+				cfg.SMTP = &SMTPConfig{Host: "localhost", Port: 25, From: "reports@example.com"}
+				cfg.Reports = []ReportDefinition{{Name: "daily", View: "users", DB: "missing", Schedule: "daily 08:00", Recipients: []string{"a@example.com"}}}
+			},
+			"not found in configs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validAppConfig()
+			tt.modify(&cfg)
+			err := validateConfig(cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	idx := func(i int) *int { return &i }
+	tests := []struct {
+		name         string
+		cfg          AppConfig
+		wantIDs      []string
+		wantDefault  string
+		wantMigrated bool
+	}{
+		{
+			name:        "already migrated",
+			cfg:         AppConfig{Configs: []Config{{ID: "main", DBName: "files"}}, DefaultDB: "main"},
+			wantIDs:     []string{"main"},
+			wantDefault: "main",
+		},
+		{
+			name: "ids from dbname",
+			cfg: AppConfig{Configs: []Config{
+				{DBName: "Files_Prod"}, {DBName: "files_prod"}, {DBName: "文件"}, {DBName: "all"},
+			}},
+			wantIDs:      []string{"files_prod", "files_prod-2", "db2", "db3"},
+			wantDefault:  "files_prod",
+			wantMigrated: true,
+		},
+		{
+			name: "generated id does not clash with an existing one",
+			cfg: AppConfig{Configs: []Config{
+				{DBName: "files"}, {ID: "files", DBName: "other"},
+			}, DefaultDB: "files"},
+			wantIDs:      []string{"files-2", "files"},
+			wantDefault:  "files",
+			wantMigrated: true,
+		},
+		{
+			name: "default index",
+			cfg: AppConfig{Configs: []Config{
+				{ID: "a", DBName: "a"}, {ID: "b", DBName: "b"},
+			}, DefaultDBIndex: idx(1)},
+			wantIDs:      []string{"a", "b"},
+			wantDefault:  "b",
+			wantMigrated: true,
+		},
+		{
+			name: "default index out of range",
+			cfg: AppConfig{Configs: []Config{
+				{ID: "a", DBName: "a"},
+			}, DefaultDBIndex: idx(5)},
+			wantIDs:      []string{"a"},
+			wantDefault:  "a",
+			wantMigrated: true,
+		},
+		{
+			name:        "unknown default falls back to the first database",
+			cfg:         AppConfig{Configs: []Config{{ID: "a"}, {ID: "b"}}, DefaultDB: "gone"},
+			wantIDs:     []string{"a", "b"},
+			wantDefault: "a",
+		},
+		{
+			name: "no databases",
+			cfg:  AppConfig{DefaultDB: "gone"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			orig := append([]Config(nil), cfg.Configs...)
+			migrated := migrateConfig(&cfg)
+			if migrated != tt.wantMigrated {
+				t.Errorf("migrated = %v, want %v", migrated, tt.wantMigrated)
+			}
+			var ids []string
+			for _, c := range cfg.Configs {
+				ids = append(ids, c.ID)
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+			if cfg.DefaultDB != tt.wantDefault {
+				t.Errorf("default = %q, want %q", cfg.DefaultDB, tt.wantDefault)
+			}
+			if cfg.DefaultDBIndex != nil {
+				t.Error("DefaultDBIndex was not cleared")
+			}
+			// 不能修改调用方的Configs切片
+			for i := range orig {
+				if tt.cfg.Configs[i].ID != orig[i].ID {
+					t.Errorf("config %d modified in place", i)
+				}
+			}
+		})
+	}
+}
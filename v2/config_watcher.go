@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"reflect"
+	"time"
+)
+
+// watchConfig 定期检查配置文件是否变化，变化后校验并热加载。
+// 使用轮询而不是inotify，兼容配置管理工具通过rename替换文件的方式。
+func watchConfig(path string, interval time.Duration, stop <-chan struct{}) {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			// 文件可能正在被替换，下次再检查
+			continue
+		}
+		if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+
+		if err := reloadConfig(path); err != nil {
+			slog.Warn("Config reload skipped, keep using current config", "err", err)
+		}
+	}
+}
+
+// reloadConfig 读取并校验配置文件，与当前配置不同时才替换
+func reloadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, _, err := parseConfig(data)
+	if err != nil {
+		return err
+	}
+	if err := validateConfig(cfg); err != nil {
+		return err
+	}
+	if reflect.DeepEqual(cfg, getAppConfig()) {
+		return nil
+	}
+
+	slog.Info("Config file changed, reloading", "path", path)
+	if err := applyConfig(cfg); err != nil {
+		slog.Error("Config reloaded with errors", "err", err)
+		return nil
+	}
+	slog.Info("Config reloaded", "configs", len(cfg.Configs), "default_db", cfg.DefaultDB)
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// 连接池默认空闲关闭时间，可通过配置conn_idle_timeout(秒)修改
+	defaultConnIdleTimeout = 10 * time.Minute
+	// 首次建立连接时ping的超时时间
+	connPingTimeout = 5 * time.Second
+)
+
+var errDBNotFound = errors.New("database connection not found or invalid")
+
+// pooledDB 连接池及其引用计数
+type pooledDB struct {
+	id       string
+	db       *sql.DB
+	refs     int
+	lastUsed time.Time
+	retired  bool // 配置替换或空闲超时后标记为退役，引用归零时关闭
+}
+
+// DBManager 管理各数据库配置对应的连接池，替代原来的全局map。
+// 连接池在首次使用时建立并ping检查，空闲超过idleTimeout后关闭，下次使用时重新建立。
+// 处理请求时通过Get获取连接池并在结束后release，
+// Reload替换连接池时旧连接池要等所有引用释放后才关闭，避免在途查询拿到已关闭的*sql.DB。
+type DBManager struct {
+	mu          sync.Mutex
+	configs     []Config
+	idleTimeout time.Duration
+	pools       map[string]*pooledDB
+	closed      bool
+	// open 建立连接池，测试时替换
+	open func(Config) (*sql.DB, error)
+}
+
+func NewDBManager() *DBManager {
+	return &DBManager{
+		idleTimeout: defaultConnIdleTimeout,
+		pools:       make(map[string]*pooledDB),
+		open:        openAndPing,
+	}
+}
+
+// Get 获取指定ID的连接池，不存在时建立连接并缓存，返回的release函数必须在使用完后调用。
+// ctx中的查询来源用于记录查询日志
+func (m *DBManager) Get(ctx context.Context, id string) (*DB, func(), error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, nil, errors.New("database manager is closed")
+	}
+	p, ok := m.pools[id]
+	if !ok {
+		cfg, found := m.findConfig(id)
+		if !found {
+			m.mu.Unlock()
+			return nil, nil, errDBNotFound
+		}
+		m.mu.Unlock()
+
+		// 建立连接不持有锁，避免慢连接阻塞其他数据库的请求
+		db, err := m.open(cfg)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to connect to database %s: %w", id, err)
+		}
+
+		m.mu.Lock()
+		if cur, found := m.findConfig(id); m.closed || !found || !sameConnection(cur, cfg) {
+			// 建立连接期间配置发生了变化
+			m.mu.Unlock()
+			db.Close()
+			return nil, nil, errDBNotFound
+		}
+		if p, ok = m.pools[id]; ok {
+			// 其他请求已经建立了连接
+			db.Close()
+		} else {
+			slog.InfoContext(ctx, "Opened connection pool", "db", id)
+			p = &pooledDB{id: id, db: db}
+			m.pools[id] = p
+		}
+	}
+	p.refs++
+	p.lastUsed = time.Now()
+	m.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { m.release(p) })
+	}
+	return newDB(ctx, id, p.db), release, nil
+}
+
+func (m *DBManager) release(p *pooledDB) {
+	m.mu.Lock()
+	p.refs--
+	p.lastUsed = time.Now()
+	closeNow := p.retired && p.refs == 0
+	m.mu.Unlock()
+
+	if closeNow {
+		slog.Info("Closing retired connection pool", "db", p.id)
+		p.db.Close()
+	}
+}
+
+// Reload 使用新配置，连接参数未变的连接池继续使用，修改或删除的连接池退役，之后按需重新建立
+func (m *DBManager) Reload(cfg AppConfig) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return errors.New("database manager is closed")
+	}
+	oldConfigs := make(map[string]Config, len(m.pools))
+	for id := range m.pools {
+		oldConfigs[id], _ = m.findConfig(id)
+	}
+	m.configs = cfg.Configs
+	m.idleTimeout = defaultConnIdleTimeout
+	if cfg.ConnIdleTimeout > 0 {
+		m.idleTimeout = time.Duration(cfg.ConnIdleTimeout) * time.Second
+	}
+	old := make(map[string]*pooledDB)
+	for id, p := range m.pools {
+		if c, ok := m.findConfig(id); ok && sameConnection(c, oldConfigs[id]) {
+			continue
+		}
+		old[id] = p
+		delete(m.pools, id)
+	}
+	m.mu.Unlock()
+
+	m.retire(old)
+	return nil
+}
+
+// Close 关闭所有连接池，仍被引用的连接池在释放后关闭
+func (m *DBManager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	old := m.pools
+	m.pools = make(map[string]*pooledDB)
+	m.mu.Unlock()
+
+	m.retire(old)
+}
+
+// Stats 返回已打开的连接池的统计信息，连接池未打开时返回false
+func (m *DBManager) Stats(id string) (sql.DBStats, bool) {
+	m.mu.Lock()
+	p, ok := m.pools[id]
+	m.mu.Unlock()
+	if !ok {
+		return sql.DBStats{}, false
+	}
+	return p.db.Stats(), true
+}
+
+// RunIdleReaper 定期关闭空闲超时的连接池，直到stop关闭
+func (m *DBManager) RunIdleReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			m.reapIdle(now)
+		}
+	}
+}
+
+// reapIdle 关闭到now为止空闲超时的连接池
+func (m *DBManager) reapIdle(now time.Time) {
+	idle := make(map[string]*pooledDB)
+	m.mu.Lock()
+	for id, p := range m.pools {
+		if p.refs == 0 && now.Sub(p.lastUsed) > m.idleTimeout {
+			idle[id] = p
+			delete(m.pools, id)
+		}
+	}
+	m.mu.Unlock()
+
+	if len(idle) > 0 {
+		m.retire(idle)
+	}
+}
+
+// findConfig 按ID查找配置，从库ID返回对应从库的连接配置，调用方需持有m.mu
+func (m *DBManager) findConfig(id string) (Config, bool) {
+	if base, idx, ok := parseReplicaID(id); ok {
+		cfg, found := m.findConfig(base)
+		if !found || idx >= len(cfg.Replicas) {
+			return Config{}, false
+		}
+		return cfg.replicaConfig(idx), true
+	}
+	for _, cfg := range m.configs {
+		if cfg.ID == id {
+			return cfg, true
+		}
+	}
+	return Config{}, false
+}
+
+// retire 将连接池标记为退役，没有引用的直接关闭
+func (m *DBManager) retire(pools map[string]*pooledDB) {
+	var idle []*pooledDB
+	m.mu.Lock()
+	for _, p := range pools {
+		p.retired = true
+		if p.refs == 0 {
+			idle = append(idle, p)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, p := range idle {
+		slog.Info("Closing retired connection pool", "db", p.id)
+		p.db.Close()
+	}
+}
+
+// openAndPing 建立连接池并ping检查，失败时关闭
+func openAndPing(cfg Config) (*sql.DB, error) {
+	db, err := connectDB(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connPingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// addMockPool 给DBManager加入一个sqlmock连接池，返回的mock用于断言连接池是否被关闭
+func addMockPool(t *testing.T, m *DBManager, id string) (*pooledDB, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pooledDB{id: id, db: sqlDB}
+	m.pools[id] = p
+	return p, mock
+}
+
+func TestDBManagerReloadKeepsUnchangedPools(t *testing.T) {
+	m := NewDBManager()
+	cfg := validAppConfig()
+	cfg.Configs[0].Replicas = []Replica{{Host: "10.0.0.3", Port: "3306"}}
+	m.configs = cfg.Configs
+	main, mainMock := addMockPool(t, m, "main")
+	backup, backupMock := addMockPool(t, m, "backup")
+	replica, replicaMock := addMockPool(t, m, replicaID("main", 0))
+	backupMock.ExpectClose()
+	replicaMock.ExpectClose()
+
+	// main只修改了描述，backup换了主机，从库被删除
+	next := validAppConfig()
+	next.Configs[0].Description = "primary"
+	next.Configs[1].Host = "10.0.0.9"
+	if err := m.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.pools["main"] != main || main.retired {
+		t.Error("unchanged pool was not carried over")
+	}
+	if _, ok := m.pools["backup"]; ok || !backup.retired {
+		t.Error("pool with a changed connection was not retired")
+	}
+	if _, ok := m.pools[replicaID("main", 0)]; ok || !replica.retired {
+		t.Error("pool of a removed replica was not retired")
+	}
+	for name, mock := range map[string]sqlmock.Sqlmock{"main": mainMock, "backup": backupMock, "replica": replicaMock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestDBManagerGetRelease(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	p, _ := addMockPool(t, m, "main")
+
+	db, release, err := m.Get(context.Background(), "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.id != "main" || db.DB != p.db {
+		t.Errorf("got pool %s, want main", db.id)
+	}
+	_, release2, err := m.Get(context.Background(), "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.refs != 2 {
+		t.Errorf("refs = %d, want 2", p.refs)
+	}
+	release()
+	release() // 重复调用不能多减引用
+	if p.refs != 1 {
+		t.Errorf("refs = %d after release, want 1", p.refs)
+	}
+	release2()
+	if p.refs != 0 {
+		t.Errorf("refs = %d after all releases, want 0", p.refs)
+	}
+
+	if _, _, err := m.Get(context.Background(), "missing"); err != errDBNotFound {
+		t.Errorf("unknown id: err = %v, want %v", err, errDBNotFound)
+	}
+}
+
+func TestDBManagerRetireWhileInUse(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	p, mock := addMockPool(t, m, "main")
+	mock.ExpectClose()
+
+	_, release, err := m.Get(context.Background(), "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := validAppConfig()
+	next.Configs[0].Host = "10.0.0.9"
+	if err := m.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if !p.retired {
+		t.Fatal("pool was not retired")
+	}
+	// 在途请求持有引用时不能关闭
+	if err := mock.ExpectationsWereMet(); err == nil {
+		t.Fatal("retired pool was closed while still in use")
+	}
+	release()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("retired pool was not closed after release: %v", err)
+	}
+}
+
+func TestDBManagerClose(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	_, mock := addMockPool(t, m, "main")
+	mock.ExpectClose()
+
+	m.Close()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("idle pool was not closed: %v", err)
+	}
+	if _, _, err := m.Get(context.Background(), "main"); err == nil {
+		t.Error("Get succeeded after Close")
+	}
+}
+
+func TestDBManagerOpenRace(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	// 两个请求同时建立连接，后完成的连接池被关闭，两个请求使用同一个连接池
+	var mu sync.Mutex
+	var mocks []sqlmock.Sqlmock
+	opening := make(chan struct{}, 2)
+	proceed := make(chan struct{})
+	m.open = func(Config) (*sql.DB, error) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		mocks = append(mocks, mock)
+		mu.Unlock()
+		opening <- struct{}{}
+		<-proceed
+		return db, nil
+	}
+
+	dbs := make([]*DB, 2)
+	var wg sync.WaitGroup
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db, release, err := m.Get(context.Background(), "backup")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer release()
+			dbs[i] = db
+		}(i)
+	}
+	<-opening
+	<-opening
+	for _, mock := range mocks {
+		mock.ExpectClose()
+	}
+	close(proceed)
+	wg.Wait()
+
+	if dbs[0] == nil || dbs[1] == nil || dbs[0].DB != dbs[1].DB {
+		t.Fatal("concurrent requests got different pools")
+	}
+	if dbs[0].DB != m.pools["backup"].db {
+		t.Error("pool in use is not the registered one")
+	}
+	closed := 0
+	for _, mock := range mocks {
+		if mock.ExpectationsWereMet() == nil {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("%d duplicate pools closed, want 1", closed)
+	}
+}
+
+func TestDBManagerConfigChangedWhileOpening(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectClose()
+	m.open = func(Config) (*sql.DB, error) {
+		// 建立连接期间backup的主机被修改
+		next := validAppConfig()
+		next.Configs[1].Host = "10.0.0.9"
+		m.Reload(next)
+		return db, nil
+	}
+	if _, _, err := m.Get(context.Background(), "backup"); err != errDBNotFound {
+		t.Errorf("err = %v, want %v", err, errDBNotFound)
+	}
+	if _, ok := m.pools["backup"]; ok {
+		t.Error("pool opened with the old config was registered")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("pool opened with the old config was not closed: %v", err)
+	}
+}
+
+func TestDBManagerReapIdle(t *testing.T) {
+	m := NewDBManager()
+	m.configs = validAppConfig().Configs
+	m.idleTimeout = time.Minute
+	now := time.Now()
+
+	idle, idleMock := addMockPool(t, m, "main")
+	idle.lastUsed = now.Add(-2 * time.Minute)
+	idleMock.ExpectClose()
+	recent, recentMock := addMockPool(t, m, "backup")
+	recent.lastUsed = now.Add(-30 * time.Second)
+	// 仍被引用的连接池即使超时也不关闭
+	busy, busyMock := addMockPool(t, m, replicaID("main", 0))
+	busy.lastUsed = now.Add(-time.Hour)
+	busy.refs = 1
+
+	m.reapIdle(now)
+
+	if _, ok := m.pools["main"]; ok || !idle.retired {
+		t.Error("idle pool was not reaped")
+	}
+	if err := idleMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("idle pool was not closed: %v", err)
+	}
+	if m.pools["backup"] != recent || m.pools[replicaID("main", 0)] != busy {
+		t.Error("pools in use or used recently were reaped")
+	}
+	for _, mock := range []sqlmock.Sqlmock{recentMock, busyMock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"sort"
 	"sync"
 )
@@ -37,6 +37,14 @@ type FileInfo struct {
 	Status string
 }
 
+// 单个bucket的文件统计
+type BucketStats struct {
+	BID   uint64
+	Part  string
+	Count uint64
+	Size  float64
+}
+
 // 指定bucket查询时，对应的信息
 type BucketCondition struct {
 	BID   uint64
@@ -44,36 +52,103 @@ type BucketCondition struct {
 	Part  string
 }
 
-func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, limit int) ([]UserStats, error) {
-	var users []UserStats
+// allPartitions 返回全部256个分区号 00~ff
+func allPartitions() []string {
+	parts := make([]string, 0, 256)
+	for i := 0; i < 256; i++ {
+		parts = append(parts, fmt.Sprintf("%02x", i))
+	}
+	return parts
+}
 
-	if bidFilter != "" || bnameFilter != "" {
-		// Direct query for specific bucket
-		query := "SELECT u.id, u.username, u.status, b.bid, b.bname, b.part FROM users u JOIN buckets b ON u.id = b.user WHERE 1=1"
-		args := []interface{}{}
+// 并发扫描分区表时的并发数
+const partitionWorkers = 8
+
+// forEachPartition 使用固定数量的goroutine对全部256个分区执行fn
+func forEachPartition(fn func(part string)) {
+	var wg sync.WaitGroup
+	partChan := make(chan string)
+	for i := 0; i < partitionWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range partChan {
+				fn(part)
+			}
+		}()
+	}
+	for _, part := range allPartitions() {
+		partChan <- part
+	}
+	close(partChan)
+	wg.Wait()
+}
 
-		if usernameFilter != "" {
-			query += " AND u.username = ?"
-			args = append(args, usernameFilter)
-		}
+// getUserParts 用户有bucket的分区
+func getUserParts(db *DB, userID uint64) ([]string, error) {
+	rows, err := db.Query("SELECT part FROM buckets WHERE user = ? GROUP BY part", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		if bidFilter != "" {
-			query += " AND b.bid = ?"
-			args = append(args, bidFilter)
-		}
-		if bnameFilter != "" {
-			query += " AND b.bname = ?"
-			args = append(args, bnameFilter)
+	var parts []string
+	for rows.Next() {
+		var part string
+		if err := rows.Scan(&part); err != nil {
+			return nil, err
 		}
-		query += " order by b.created_at desc"
+		parts = append(parts, part)
+	}
+	return parts, rows.Err()
+}
 
-		// 每个用户只查询limit个分区
-		if limit > 0 {
-			query += " LIMIT ?"
-			args = append(args, limit)
-		}
+// 用户列表查询，usernameFilter为空时返回全部用户
+func userListQuery(usernameFilter string) (string, []interface{}) {
+	query := "SELECT id, username, status FROM users WHERE 1=1"
+	args := []interface{}{}
+	if usernameFilter != "" {
+		query += " AND username = ?"
+		args = append(args, usernameFilter)
+	}
+	return query, args
+}
+
+// bucket搜索查询，返回用户和bucket信息
+func bucketSearchQuery(bidFilter, bnameFilter, usernameFilter string, limit int) (string, []interface{}) {
+	query := "SELECT u.id, u.username, u.status, b.bid, b.bname, b.part FROM users u JOIN buckets b ON u.id = b.user WHERE 1=1"
+	args := []interface{}{}
+
+	if usernameFilter != "" {
+		query += " AND u.username = ?"
+		args = append(args, usernameFilter)
+	}
+
+	if bidFilter != "" {
+		query += " AND b.bid = ?"
+		args = append(args, bidFilter)
+	}
+	if bnameFilter != "" {
+		query += " AND b.bname = ?"
+		args = append(args, bnameFilter)
+	}
+	query += " order by b.created_at desc"
+
+	// 每个用户只查询limit个分区
+	if limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return query, args
+}
+
+func getUserStats(db *DB, bidFilter, bnameFilter, usernameFilter string, limit int) ([]UserStats, error) {
+	var users []UserStats
+
+	if bidFilter != "" || bnameFilter != "" {
+		// Direct query for specific bucket
+		query, args := bucketSearchQuery(bidFilter, bnameFilter, usernameFilter, limit)
 
-		log.Printf("Executing query: %s with args: %v", query, args)
 		rows, err := db.Query(query, args...)
 		if err != nil {
 			return nil, err
@@ -99,7 +174,7 @@ func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, lim
 				defer wg.Done()
 				partitions, err := getUserPartitions(db, bc, u.ID, u.Username, limit)
 				if err != nil {
-					log.Printf("Error getting partitions for user %s: %v", u.Username, err)
+					slog.WarnContext(db.ctx, "Error getting partitions for user", "username", u.Username, "err", err)
 					return
 				}
 
@@ -108,7 +183,6 @@ func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, lim
 					u.TotalFiles += p.Count
 					u.TotalSize += p.Size
 				}
-				u.TotalSize = u.TotalSize
 				userChan <- u
 			}(user, bucketCond)
 		}
@@ -123,14 +197,8 @@ func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, lim
 		}
 	} else {
 		// Original logic for all users
-		query := "SELECT id, username, status FROM users WHERE 1=1"
-		args := []interface{}{}
-		if usernameFilter != "" {
-			query += " AND username = ?"
-			args = append(args, usernameFilter)
-		}
+		query, args := userListQuery(usernameFilter)
 
-		log.Printf("Executing query: %s with args: %v", query, args)
 		rows, err := db.Query(query, args...)
 		if err != nil {
 			return nil, err
@@ -154,7 +222,7 @@ func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, lim
 				defer wg.Done()
 				partitions, err := getUserPartitions(db, BucketCondition{}, u.ID, u.Username, limit)
 				if err != nil {
-					log.Printf("Error getting partitions for user %s: %v", u.Username, err)
+					slog.WarnContext(db.ctx, "Error getting partitions for user", "username", u.Username, "err", err)
 					return
 				}
 				u.Partitions = partitions
@@ -183,12 +251,12 @@ func getUserStats(db *sql.DB, bidFilter, bnameFilter, usernameFilter string, lim
 	return users, nil
 }
 
-func getUserPartitions(db *sql.DB, bucketCond BucketCondition, userID uint64, username string, limit int) ([]PartitionStats, error) {
+func getUserPartitions(db *DB, bucketCond BucketCondition, userID uint64, username string, limit int) ([]PartitionStats, error) {
 	var partitions []PartitionStats
 
 	if bucketCond.BID > 0 && bucketCond.Part != "" {
-		// Get single partition stats for specific bucket
-		stats, err := getPartitionStats(db, bucketCond.BID, bucketCond.Part)
+		// Get stats for the specific bucket only
+		stats, err := getBucketStats(db, bucketCond.BID, bucketCond.Part)
 		if err != nil {
 			return nil, err
 		}
@@ -213,7 +281,6 @@ func getUserPartitions(db *sql.DB, bucketCond BucketCondition, userID uint64, us
 			args = append(args, limit)
 		}
 
-		log.Printf("Executing partition query: %s with args: %v", query, args)
 		rows, err := db.Query(query, args...)
 		if err != nil {
 			return nil, err
@@ -243,7 +310,7 @@ func getUserPartitions(db *sql.DB, bucketCond BucketCondition, userID uint64, us
 
 				stats, err := getPartitionStats(db, userID, p)
 				if err != nil {
-					log.Printf("Error getting partition stats for user %d, part %s: %v", userID, p, err)
+					slog.WarnContext(db.ctx, "Error getting partition stats", "user", userID, "part", p, "err", err)
 					return
 				}
 
@@ -255,7 +322,7 @@ func getUserPartitions(db *sql.DB, bucketCond BucketCondition, userID uint64, us
 				var bname string
 				err = db.QueryRow("SELECT bid, bname FROM buckets WHERE user = ? AND part = ? LIMIT 1", userID, p).Scan(&bid, &bname)
 				if err != nil && err != sql.ErrNoRows {
-					log.Printf("Error getting bucket info for user %d, part %s: %v", userID, p, err)
+					slog.WarnContext(db.ctx, "Error getting bucket info", "user", userID, "part", p, "err", err)
 				}
 
 				partitionChan <- PartitionStats{
@@ -287,7 +354,7 @@ func getUserPartitions(db *sql.DB, bucketCond BucketCondition, userID uint64, us
 }
 
 // 用户在指定分区的文件统计
-func getPartitionStats(db *sql.DB, userID uint64, part string) (*PartitionStats, error) {
+func getPartitionStats(db *DB, userID uint64, part string) (*PartitionStats, error) {
 	// Query file count and total size for this partition
 	query := fmt.Sprintf(
 		"SELECT COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s WHERE bid IN "+
@@ -314,8 +381,21 @@ func getPartitionStats(db *sql.DB, userID uint64, part string) (*PartitionStats,
 	return &stats, nil
 }
 
-func getFiles(db *sql.DB, userID uint64, part string, fid uint64, fname string, bucketID uint64) ([]FileInfo, error) {
-	// Build query for files in this partition
+// bucket在其分区中的文件统计，同一分区中其他bucket的文件不计入
+func getBucketStats(db *DB, bid uint64, part string) (*BucketStats, error) {
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s WHERE bid = ?", part)
+
+	stats := BucketStats{BID: bid, Part: part}
+	if err := db.QueryRow(query, bid).Scan(&stats.Count, &stats.Size); err != nil {
+		return nil, fmt.Errorf("failed to scan bucket stats: %w", err)
+	}
+	stats.Size = stats.Size / 1024.0 / 1024 // Convert bytes to MB
+
+	return &stats, nil
+}
+
+// 用户在指定分区的文件查询，按创建时间倒序，不带LIMIT。part拼接到表名中，调用方需先用isValidPartition检查
+func filesQuery(userID uint64, part string, fid uint64, fname string, bucketID uint64) (string, []interface{}) {
 	query := fmt.Sprintf(
 		"SELECT fid, fname, bid, fsize, status FROM bucket_files_%s "+
 			"WHERE bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)", part)
@@ -336,10 +416,15 @@ func getFiles(db *sql.DB, userID uint64, part string, fid uint64, fname string,
 		args = append(args, bucketID)
 	}
 	query += " order by created_at desc"
+	return query, args
+}
 
+func getFiles(db *DB, userID uint64, part string, fid uint64, fname string, bucketID uint64) ([]FileInfo, error) {
+	if !isValidPartition(part) {
+		return nil, fmt.Errorf("invalid partition %q", part)
+	}
+	query, args := filesQuery(userID, part, fid, fname, bucketID)
 	query += " LIMIT 20"
-	log.Printf("Query: %s, Args: %v", query, args)
-
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, err
@@ -355,7 +440,6 @@ func getFiles(db *sql.DB, userID uint64, part string, fid uint64, fname string,
 		file.FSize = file.FSize / 1024.0 / 1024 // Convert bytes to MB
 		files = append(files, file)
 	}
-	log.Printf("Files: %v", files)
 
 	return files, nil
 }
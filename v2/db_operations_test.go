@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newMockDB 返回使用sqlmock的DB，测试结束时检查所有预期的查询都已执行
+func newMockDB(t *testing.T) (*DB, sqlmock.Sqlmock) {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		sqlDB.Close()
+	})
+	return newDB(context.Background(), "test", sqlDB), mock
+}
+
+const mb = 1024 * 1024
+
+// 用户7在分区3f中有两个bucket: 101有3个文件共3MB，102有5个文件共10MB
+var bucketFiles3f = map[uint64]struct{ count, bytes uint64 }{
+	101: {3, 3 * mb},
+	102: {5, 10 * mb},
+}
+
+func TestGetBucketStats(t *testing.T) {
+	tests := []struct {
+		name      string
+		bid       uint64
+		part      string
+		wantCount uint64
+		wantSize  float64
+	}{
+		{"first bucket in shared partition", 101, "3f", 3, 3},
+		{"second bucket in shared partition", 102, "3f", 5, 10},
+		{"bucket without files", 103, "3f", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			files := bucketFiles3f[tt.bid]
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_3f WHERE bid = ?")).
+				WithArgs(tt.bid).
+				WillReturnRows(sqlmock.NewRows([]string{"count", "size"}).AddRow(files.count, files.bytes))
+
+			stats, err := getBucketStats(db, tt.bid, tt.part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.BID != tt.bid || stats.Part != tt.part {
+				t.Errorf("got bucket %d in %s, want %d in %s", stats.BID, stats.Part, tt.bid, tt.part)
+			}
+			if stats.Count != tt.wantCount || stats.Size != tt.wantSize {
+				t.Errorf("got %d files %.2f MB, want %d files %.2f MB", stats.Count, stats.Size, tt.wantCount, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestGetUserPartitions(t *testing.T) {
+	tests := []struct {
+		name  string
+		cond  BucketCondition
+		setup func(mock sqlmock.Sqlmock)
+		want  []PartitionStats
+	}{
+		{
+			// 只统计指定的bucket，同分区中同一用户的另一个bucket不计入
+			name: "bucket search counts only that bucket",
+			cond: BucketCondition{BID: 102, BName: "photos", Part: "3f"},
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta("FROM bucket_files_3f WHERE bid = ?")).
+					WithArgs(uint64(102)).
+					WillReturnRows(sqlmock.NewRows([]string{"count", "size"}).AddRow(5, 10*mb))
+			},
+			want: []PartitionStats{
+				{UserID: 7, Username: "alice", Part: "3f", Count: 5, Size: 10, BID: 102, BName: "photos"},
+			},
+		},
+		{
+			// 不指定bucket时按分区汇总该用户所有bucket
+			name: "user search sums buckets sharing a partition",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT part FROM buckets WHERE user = ? GROUP BY part")).
+					WithArgs(uint64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"part"}).AddRow("3f"))
+				mock.ExpectQuery(regexp.QuoteMeta("FROM bucket_files_3f WHERE bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)")).
+					WithArgs(uint64(7), "3f").
+					WillReturnRows(sqlmock.NewRows([]string{"count", "size"}).AddRow(8, 13*mb))
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT bid, bname FROM buckets WHERE user = ? AND part = ? LIMIT 1")).
+					WithArgs(uint64(7), "3f").
+					WillReturnRows(sqlmock.NewRows([]string{"bid", "bname"}).AddRow(101, "docs"))
+			},
+			want: []PartitionStats{
+				{UserID: 7, Username: "alice", Part: "3f", Count: 8, Size: 13, BID: 101, BName: "docs"},
+			},
+		},
+		{
+			name: "partitions without files are skipped",
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT part FROM buckets WHERE user = ? GROUP BY part")).
+					WithArgs(uint64(7)).
+					WillReturnRows(sqlmock.NewRows([]string{"part"}).AddRow("00"))
+				mock.ExpectQuery(regexp.QuoteMeta("FROM bucket_files_00 WHERE bid IN")).
+					WithArgs(uint64(7), "00").
+					WillReturnRows(sqlmock.NewRows([]string{"count", "size"}).AddRow(0, 0))
+			},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			tt.setup(mock)
+
+			got, err := getUserPartitions(db, tt.cond, 7, "alice", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d partitions %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("partition %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 报告中保留的重复组数量，按可回收空间排序
+	maxDuplicateGroups = 1000
+	// 每个重复组保留的位置数量
+	maxDuplicateLocations = 20
+	// 第一遍扫描计数的槽位数，内存固定为16MB
+	dupCounterSlots = 1 << 24
+	// 第二遍扫描最多保留的候选(fname, fsize)数量
+	maxDuplicateCandidates = 200000
+	// 页面每页显示的重复组数量
+	duplicatesPageSize = 100
+)
+
+// 重复文件的范围
+const (
+	DupScopeBucket = "bucket" // 都在同一个bucket内
+	DupScopeUser   = "user"   // 同一用户的多个bucket
+	DupScopeGlobal = "global" // 跨用户
+)
+
+// DuplicateLocation 重复文件所在的bucket
+type DuplicateLocation struct {
+	Part   string `json:"part"`
+	BID    uint64 `json:"bid"`
+	UserID uint64 `json:"user_id"`
+	Count  uint64 `json:"count"`
+}
+
+// DuplicateGroup fname和fsize都相同的一组文件
+type DuplicateGroup struct {
+	FName            string              `json:"fname"`
+	FSize            uint64              `json:"fsize"`
+	Count            uint64              `json:"count"`
+	Scope            string              `json:"scope"`
+	Users            int                 `json:"users"`
+	Buckets          int                 `json:"buckets"`
+	Parts            []string            `json:"parts"`
+	ReclaimableBytes uint64              `json:"reclaimable_bytes"`
+	Locations        []DuplicateLocation `json:"locations"`
+}
+
+func (g DuplicateGroup) ReclaimableMB() float64 { return bytesToMB(g.ReclaimableBytes) }
+
+// DuplicateSummary 按用户、bucket或分区汇总的重复情况。
+// 用户和bucket维度的可回收空间只计算该用户/bucket内部的重复，每个文件保留一份
+type DuplicateSummary struct {
+	UserID           uint64 `json:"user_id,omitempty"`
+	Username         string `json:"username,omitempty"`
+	BID              uint64 `json:"bid,omitempty"`
+	Part             string `json:"part,omitempty"`
+	Groups           int    `json:"groups"`
+	DuplicateFiles   uint64 `json:"duplicate_files"`
+	ReclaimableBytes uint64 `json:"reclaimable_bytes"`
+}
+
+func (s DuplicateSummary) ReclaimableMB() float64 { return bytesToMB(s.ReclaimableBytes) }
+
+// DuplicateReport 一次重复文件扫描的结果
+type DuplicateReport struct {
+	DB                    string             `json:"db"`
+	MinSize               uint64             `json:"min_size"`
+	TotalGroups           int                `json:"total_groups"`
+	TotalDuplicateFiles   uint64             `json:"total_duplicate_files"`
+	TotalReclaimableBytes uint64             `json:"total_reclaimable_bytes"`
+	Groups                []DuplicateGroup   `json:"groups"`
+	ByUser                []DuplicateSummary `json:"by_user"`
+	ByBucket              []DuplicateSummary `json:"by_bucket"`
+	ByPartition           []DuplicateSummary `json:"by_partition"`
+	Errors                []string           `json:"errors,omitempty"`
+	Route                 *ReadRoute         `json:"read_route,omitempty"`
+}
+
+func (r *DuplicateReport) TotalReclaimableMB() float64 { return bytesToMB(r.TotalReclaimableBytes) }
+
+// DuplicateJob 后台扫描任务的状态
+type DuplicateJob struct {
+	DB         string           `json:"db"`
+	Status     string           `json:"status"` // running, done, failed
+	Progress   int              `json:"progress"`
+	Total      int              `json:"total"`
+	StartedAt  time.Time        `json:"started_at"`
+	FinishedAt time.Time        `json:"finished_at,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Report     *DuplicateReport `json:"report,omitempty"`
+}
+
+// DuplicateJobs 保存每个数据库最近一次的扫描任务，结果保留到下次扫描
+type DuplicateJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*DuplicateJob
+}
+
+var duplicateJobs = &DuplicateJobs{jobs: make(map[string]*DuplicateJob)}
+
+// Start 启动扫描任务，同一数据库已有任务在运行时不重复启动
+func (j *DuplicateJobs) Start(ctx context.Context, dbID string, minSize uint64) (*DuplicateJob, error) {
+	// 检查和登记在同一个临界区内，并发的请求不会启动两个任务
+	j.mu.Lock()
+	prev, ok := j.jobs[dbID]
+	if ok && prev.Status == "running" {
+		j.mu.Unlock()
+		return prev, nil
+	}
+	job := &DuplicateJob{DB: dbID, Status: "running", Total: 2 * len(allPartitions()), StartedAt: time.Now()}
+	j.jobs[dbID] = job
+	j.mu.Unlock()
+
+	// 任务运行期间持有连接池引用，配置重载不会关闭它
+	db, release, route, err := getReadDB(ctx, dbID)
+	if err != nil {
+		// 恢复上一次的结果
+		j.mu.Lock()
+		if prev != nil {
+			j.jobs[dbID] = prev
+		} else {
+			delete(j.jobs, dbID)
+		}
+		j.mu.Unlock()
+		return nil, err
+	}
+
+	go func() {
+		defer release()
+		report, err := findDuplicates(db, minSize, func(done int) {
+			j.mu.Lock()
+			job.Progress = done
+			j.mu.Unlock()
+		})
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		job.FinishedAt = time.Now()
+		if err != nil {
+			slog.ErrorContext(db.ctx, "Duplicate scan failed", "db", dbID, "err", err)
+			job.Status = "failed"
+			job.Error = err.Error()
+			return
+		}
+		report.DB = dbID
+		report.Route = &route
+		job.Status = "done"
+		job.Report = report
+		slog.InfoContext(db.ctx, "Duplicate scan completed", "db", dbID, "elapsed", job.FinishedAt.Sub(job.StartedAt), "groups", report.TotalGroups)
+	}()
+	return job, nil
+}
+
+// Get 返回任务状态的副本
+func (j *DuplicateJobs) Get(dbID string) (DuplicateJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[dbID]
+	if !ok {
+		return DuplicateJob{}, false
+	}
+	return *job, true
+}
+
+// dupKey 文件名和大小相同视为重复
+type dupKey struct {
+	fname string
+	fsize uint64
+}
+
+type bucketKey struct {
+	part string
+	bid  uint64
+}
+
+// dupAccumulator 扫描过程中某个(fname, fsize)出现的位置
+type dupAccumulator struct {
+	count     uint64
+	locations []DuplicateLocation
+}
+
+// dupCounter 按(fname, fsize)的哈希计数，最多计到2。
+// 哈希冲突只会多出候选，第二遍扫描按实际数量过滤
+type dupCounter []uint8
+
+func newDupCounter() dupCounter {
+	return make(dupCounter, dupCounterSlots)
+}
+
+func (c dupCounter) slot(key dupKey) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key.fname)
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], key.fsize)
+	h.Write(size[:])
+	return h.Sum64() % uint64(len(c))
+}
+
+func (c dupCounter) add(key dupKey, n uint64) {
+	i := c.slot(key)
+	c[i] = uint8(min(uint64(c[i])+n, 2))
+}
+
+// maybeDuplicate 键可能出现了两次以上
+func (c dupCounter) maybeDuplicate(key dupKey) bool {
+	return c[c.slot(key)] >= 2
+}
+
+// findDuplicates 分两遍扫描256个分区表：第一遍只在SQL中按(fname, fsize)汇总并计数，
+// 第二遍只保留可能重复的键的位置，内存不随文件总数增长
+func findDuplicates(db *DB, minSize uint64, progress func(done int)) (*DuplicateReport, error) {
+	report := &DuplicateReport{MinSize: minSize}
+	parts := allPartitions()
+
+	counts := newDupCounter()
+	for i, part := range parts {
+		if err := countPartitionFiles(db, part, minSize, counts); err != nil {
+			slog.WarnContext(db.ctx, "Duplicate count for partition failed", "part", part, "err", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("partition %s: %v", part, err))
+		}
+		progress(i + 1)
+	}
+
+	groups := make(map[dupKey]*dupAccumulator)
+	truncated := false
+	for i, part := range parts {
+		t, err := scanPartitionFiles(db, part, minSize, counts, groups)
+		if err != nil {
+			slog.WarnContext(db.ctx, "Duplicate scan for partition failed", "part", part, "err", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("partition %s: %v", part, err))
+		}
+		truncated = truncated || t
+		progress(len(parts) + i + 1)
+	}
+	if truncated {
+		report.Errors = append(report.Errors, fmt.Sprintf("more than %d candidate groups, remaining files were skipped; raise min_size to narrow the scan", maxDuplicateCandidates))
+	}
+
+	usernames, err := getUsernames(db)
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[uint64]*DuplicateSummary)
+	byBucket := make(map[bucketKey]*DuplicateSummary)
+	byPart := make(map[string]*DuplicateSummary)
+	for key, acc := range groups {
+		if acc.count < 2 {
+			continue
+		}
+		g := DuplicateGroup{
+			FName:            key.fname,
+			FSize:            key.fsize,
+			Count:            acc.count,
+			ReclaimableBytes: (acc.count - 1) * key.fsize,
+		}
+
+		userCounts := make(map[uint64]uint64)
+		partCounts := make(map[string]uint64)
+		for _, loc := range acc.locations {
+			userCounts[loc.UserID] += loc.Count
+			partCounts[loc.Part] += loc.Count
+
+			if loc.Count > 1 {
+				s := byBucket[bucketKey{loc.Part, loc.BID}]
+				if s == nil {
+					s = &DuplicateSummary{BID: loc.BID, Part: loc.Part, UserID: loc.UserID, Username: usernames[loc.UserID]}
+					byBucket[bucketKey{loc.Part, loc.BID}] = s
+				}
+				s.Groups++
+				s.DuplicateFiles += loc.Count
+				s.ReclaimableBytes += (loc.Count - 1) * key.fsize
+			}
+		}
+		for uid, n := range userCounts {
+			if n < 2 {
+				continue
+			}
+			s := byUser[uid]
+			if s == nil {
+				s = &DuplicateSummary{UserID: uid, Username: usernames[uid]}
+				byUser[uid] = s
+			}
+			s.Groups++
+			s.DuplicateFiles += n
+			s.ReclaimableBytes += (n - 1) * key.fsize
+		}
+		for part, n := range partCounts {
+			s := byPart[part]
+			if s == nil {
+				s = &DuplicateSummary{Part: part}
+				byPart[part] = s
+			}
+			s.Groups++
+			s.DuplicateFiles += n
+			g.Parts = append(g.Parts, part)
+		}
+		sort.Strings(g.Parts)
+
+		g.Users = len(userCounts)
+		g.Buckets = len(acc.locations)
+		switch {
+		case g.Users > 1:
+			g.Scope = DupScopeGlobal
+		case g.Buckets > 1:
+			g.Scope = DupScopeUser
+		default:
+			g.Scope = DupScopeBucket
+		}
+
+		sort.Slice(acc.locations, func(i, j int) bool { return acc.locations[i].Count > acc.locations[j].Count })
+		if len(acc.locations) > maxDuplicateLocations {
+			g.Locations = acc.locations[:maxDuplicateLocations]
+		} else {
+			g.Locations = acc.locations
+		}
+
+		report.TotalGroups++
+		report.TotalDuplicateFiles += g.Count
+		report.TotalReclaimableBytes += g.ReclaimableBytes
+		report.Groups = append(report.Groups, g)
+	}
+
+	sort.Slice(report.Groups, func(i, j int) bool {
+		return report.Groups[i].ReclaimableBytes > report.Groups[j].ReclaimableBytes
+	})
+	if len(report.Groups) > maxDuplicateGroups {
+		report.Groups = report.Groups[:maxDuplicateGroups]
+	}
+	report.ByUser = sortedSummaries(byUser)
+	report.ByBucket = sortedSummaries(byBucket)
+	report.ByPartition = sortedSummaries(byPart)
+	return report, nil
+}
+
+// countPartitionFiles 在SQL中按(fname, fsize)汇总单个分区表，计数合并到counts中
+func countPartitionFiles(db *DB, part string, minSize uint64, counts dupCounter) error {
+	query := fmt.Sprintf("SELECT fname, fsize, COUNT(*) FROM bucket_files_%s WHERE fsize >= ? GROUP BY fname, fsize", part)
+	rows, err := db.Query(query, minSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key dupKey
+		var n uint64
+		if err := rows.Scan(&key.fname, &key.fsize, &n); err != nil {
+			return err
+		}
+		counts.add(key, n)
+	}
+	return rows.Err()
+}
+
+// scanPartitionFiles 统计单个分区表中每个bucket下(fname, fsize)的数量，可能重复的合并到groups中。
+// groups达到maxDuplicateCandidates后不再加入新的键，此时truncated为true
+func scanPartitionFiles(db *DB, part string, minSize uint64, counts dupCounter, groups map[dupKey]*dupAccumulator) (truncated bool, err error) {
+	query := fmt.Sprintf(
+		"SELECT f.fname, f.fsize, f.bid, COALESCE(b.user, 0), COUNT(*) FROM bucket_files_%s f "+
+			"LEFT JOIN buckets b ON f.bid = b.bid WHERE f.fsize >= ? "+
+			"GROUP BY f.fname, f.fsize, f.bid, b.user", part)
+	rows, err := db.Query(query, minSize)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key dupKey
+		loc := DuplicateLocation{Part: part}
+		if err := rows.Scan(&key.fname, &key.fsize, &loc.BID, &loc.UserID, &loc.Count); err != nil {
+			return truncated, err
+		}
+		if !counts.maybeDuplicate(key) {
+			continue
+		}
+		acc := groups[key]
+		if acc == nil {
+			if len(groups) >= maxDuplicateCandidates {
+				truncated = true
+				continue
+			}
+			acc = &dupAccumulator{}
+			groups[key] = acc
+		}
+		acc.count += loc.Count
+		acc.locations = append(acc.locations, loc)
+	}
+	return truncated, rows.Err()
+}
+
+// getUsernames 查询所有用户的ID和用户名
+func getUsernames(db *DB) (map[uint64]string, error) {
+	rows, err := db.Query("SELECT id, username FROM users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[uint64]string)
+	for rows.Next() {
+		var id uint64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
+
+func sortedSummaries[K comparable](m map[K]*DuplicateSummary) []DuplicateSummary {
+	list := make([]DuplicateSummary, 0, len(m))
+	for _, s := range m {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].ReclaimableBytes != list[j].ReclaimableBytes {
+			return list[i].ReclaimableBytes > list[j].ReclaimableBytes
+		}
+		return list[i].DuplicateFiles > list[j].DuplicateFiles
+	})
+	return list
+}
+
+func bytesToMB(n uint64) float64 {
+	return float64(n) / 1024.0 / 1024
+}
+
+// duplicatesHandler 重复文件页面，GET查看最近一次扫描结果，POST启动新的扫描
+func duplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Handling duplicates request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		minSize, err := parseMinSize(r.FormValue("min_size"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := duplicateJobs.Start(r.Context(), dbID, minSize); err != nil {
+			http.Error(w, "Database connection not available: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/duplicates?db="+dbID, http.StatusSeeOther)
+		return
+	}
+
+	// 按范围和用户过滤重复组，分页浏览
+	scope := r.URL.Query().Get("scope")
+	userFilter, _ := strconv.ParseUint(r.URL.Query().Get("user"), 10, 64)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	data := map[string]interface{}{
+		"Configs":    cfg.Configs,
+		"SelectedDB": dbID,
+		"Scope":      scope,
+		"UserFilter": r.URL.Query().Get("user"),
+	}
+	job, ok := duplicateJobs.Get(dbID)
+	if ok {
+		data["Job"] = job
+		if job.Report != nil {
+			var groups []DuplicateGroup
+			for _, g := range job.Report.Groups {
+				if scope != "" && g.Scope != scope {
+					continue
+				}
+				if userFilter > 0 && !groupHasUser(g, userFilter) {
+					continue
+				}
+				groups = append(groups, g)
+			}
+			start := (page - 1) * duplicatesPageSize
+			if start > len(groups) {
+				start = len(groups)
+			}
+			end := start + duplicatesPageSize
+			if end > len(groups) {
+				end = len(groups)
+			}
+			data["Groups"] = groups[start:end]
+			data["Page"] = page
+			if page > 1 {
+				data["PrevPage"] = page - 1
+			}
+			if end < len(groups) {
+				data["NextPage"] = page + 1
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/duplicates.html", "templates/read_route.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// duplicatesAPIHandler GET返回最近一次扫描任务的状态和结果，POST启动新的扫描
+func duplicatesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		minSize, err := parseMinSize(r.FormValue("min_size"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := duplicateJobs.Start(r.Context(), dbID, minSize); err != nil {
+			http.Error(w, "Database connection not available: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	job, ok := duplicateJobs.Get(dbID)
+	if !ok {
+		http.Error(w, "No duplicate scan has been run for this database", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+func parseMinSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid min_size %q", s)
+	}
+	return n, nil
+}
+
+func groupHasUser(g DuplicateGroup, userID uint64) bool {
+	for _, loc := range g.Locations {
+		if loc.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// 用户1的bucket 10(分区0a)和11(分区0b)、用户2的bucket 20(分区0b)都有report.pdf；
+// a.txt在用户1的两个bucket中各一份，b.txt在bucket 20中有三份，c.txt没有重复
+func TestFindDuplicates(t *testing.T) {
+	db, mock := newMockDB(t)
+	countRows := map[string][][]driver.Value{
+		"0a": {{"report.pdf", 100, 2}, {"a.txt", 50, 1}, {"c.txt", 5, 1}},
+		"0b": {{"report.pdf", 100, 2}, {"a.txt", 50, 1}, {"b.txt", 10, 3}},
+	}
+	scanRows := map[string][][]driver.Value{
+		"0a": {{"report.pdf", 100, 10, 1, 2}, {"a.txt", 50, 10, 1, 1}, {"c.txt", 5, 10, 1, 1}},
+		"0b": {{"report.pdf", 100, 11, 1, 1}, {"report.pdf", 100, 20, 2, 1}, {"a.txt", 50, 11, 1, 1}, {"b.txt", 10, 20, 2, 3}},
+	}
+	for _, part := range allPartitions() {
+		rows := sqlmock.NewRows([]string{"fname", "fsize", "count"})
+		for _, r := range countRows[part] {
+			rows.AddRow(r...)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf("FROM bucket_files_%s WHERE fsize >= ? GROUP BY fname, fsize", part))).
+			WithArgs(uint64(1)).WillReturnRows(rows)
+	}
+	for _, part := range allPartitions() {
+		rows := sqlmock.NewRows([]string{"fname", "fsize", "bid", "user", "count"})
+		for _, r := range scanRows[part] {
+			rows.AddRow(r...)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf("FROM bucket_files_%s f LEFT JOIN buckets", part))).
+			WithArgs(uint64(1)).WillReturnRows(rows)
+	}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, username FROM users")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username"}).AddRow(1, "alice").AddRow(2, "bob"))
+
+	lastProgress := 0
+	report, err := findDuplicates(db, 1, func(done int) { lastProgress = done })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastProgress != 512 {
+		t.Errorf("progress ended at %d, want 512", lastProgress)
+	}
+	if len(report.Errors) > 0 {
+		t.Errorf("unexpected errors: %v", report.Errors)
+	}
+	if report.TotalGroups != 3 || report.TotalDuplicateFiles != 9 || report.TotalReclaimableBytes != 370 {
+		t.Errorf("totals: %d groups, %d files, %d bytes", report.TotalGroups, report.TotalDuplicateFiles, report.TotalReclaimableBytes)
+	}
+
+	wantGroups := []struct {
+		fname            string
+		scope            string
+		count            uint64
+		users, buckets   int
+		parts            string
+		reclaimableBytes uint64
+	}{
+		{"report.pdf", DupScopeGlobal, 4, 2, 3, "[0a 0b]", 300},
+		{"a.txt", DupScopeUser, 2, 1, 2, "[0a 0b]", 50},
+		{"b.txt", DupScopeBucket, 3, 1, 1, "[0b]", 20},
+	}
+	if len(report.Groups) != len(wantGroups) {
+		t.Fatalf("got %d groups, want %d", len(report.Groups), len(wantGroups))
+	}
+	for i, w := range wantGroups {
+		g := report.Groups[i]
+		if g.FName != w.fname || g.Scope != w.scope || g.Count != w.count || g.Users != w.users ||
+			g.Buckets != w.buckets || fmt.Sprint(g.Parts) != w.parts || g.ReclaimableBytes != w.reclaimableBytes {
+			t.Errorf("group %d: got %+v, want %+v", i, g, w)
+		}
+	}
+	if loc := report.Groups[0].Locations[0]; loc.BID != 10 || loc.Count != 2 {
+		t.Errorf("locations should be sorted by count, first is %+v", loc)
+	}
+
+	// 用户和bucket只计算内部的重复: alice的report.pdf有3份、a.txt有2份，bob只有b.txt
+	wantSummaries := map[string][]DuplicateSummary{
+		"user": {
+			{UserID: 1, Username: "alice", Groups: 2, DuplicateFiles: 5, ReclaimableBytes: 250},
+			{UserID: 2, Username: "bob", Groups: 1, DuplicateFiles: 3, ReclaimableBytes: 20},
+		},
+		"bucket": {
+			{BID: 10, Part: "0a", UserID: 1, Username: "alice", Groups: 1, DuplicateFiles: 2, ReclaimableBytes: 100},
+			{BID: 20, Part: "0b", UserID: 2, Username: "bob", Groups: 1, DuplicateFiles: 3, ReclaimableBytes: 20},
+		},
+		"partition": {
+			{Part: "0b", Groups: 3, DuplicateFiles: 6},
+			{Part: "0a", Groups: 2, DuplicateFiles: 3},
+		},
+	}
+	for name, got := range map[string][]DuplicateSummary{"user": report.ByUser, "bucket": report.ByBucket, "partition": report.ByPartition} {
+		want := wantSummaries[name]
+		if len(got) != len(want) {
+			t.Errorf("%s summaries: got %+v, want %+v", name, got, want)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s summary %d: got %+v, want %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+}
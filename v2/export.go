@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 每写多少行刷新一次输出
+const exportFlushRows = 100
+
+// exportWriter 按行写出导出数据
+type exportWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(values []interface{}) error
+	Flush() error
+	Close() error
+}
+
+// exportFormats 格式 -> Content-Type、扩展名和writer构造函数
+var exportFormats = map[string]struct {
+	contentType string
+	ext         string
+	newWriter   func(w io.Writer) exportWriter
+}{
+	"csv":    {"text/csv; charset=utf-8", "csv", newCSVExportWriter},
+	"ndjson": {"application/x-ndjson", "ndjson", newNDJSONExportWriter},
+	"xlsx":   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx", newXLSXExportWriter},
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) exportWriter {
+	return &csvExportWriter{w: csv.NewWriter(w)}
+}
+
+func (c *csvExportWriter) WriteHeader(columns []string) error {
+	return c.w.Write(columns)
+}
+
+func (c *csvExportWriter) WriteRow(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvExportWriter) Flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvExportWriter) Close() error {
+	return c.Flush()
+}
+
+// ndjsonExportWriter 每行一个JSON对象，字段顺序与列顺序一致
+type ndjsonExportWriter struct {
+	w       io.Writer
+	columns []string
+}
+
+func newNDJSONExportWriter(w io.Writer) exportWriter {
+	return &ndjsonExportWriter{w: w}
+}
+
+func (n *ndjsonExportWriter) WriteHeader(columns []string) error {
+	n.columns = columns
+	return nil
+}
+
+func (n *ndjsonExportWriter) WriteRow(values []interface{}) error {
+	buf, err := jsonRow(n.columns, values)
+	if err != nil {
+		return err
+	}
+	_, err = n.w.Write(append(buf, '\n'))
+	return err
+}
+
+// jsonRow 将一行编码为JSON对象，字段顺序与列顺序一致
+func jsonRow(columns []string, values []interface{}) ([]byte, error) {
+	buf := []byte{'{'}
+	for i, v := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, _ := json.Marshal(columns[i])
+		val, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, key...)
+		buf = append(buf, ':')
+		buf = append(buf, val...)
+	}
+	return append(buf, '}'), nil
+}
+
+func (n *ndjsonExportWriter) Flush() error { return nil }
+
+func (n *ndjsonExportWriter) Close() error { return nil }
+
+// xlsxExportWriter 用archive/zip生成只有一个工作表的xlsx，工作表内容边查询边写出
+type xlsxExportWriter struct {
+	out   io.Writer
+	zw    *zip.Writer
+	sheet io.Writer
+	err   error
+	// 每列是否为ID，ID写成文本
+	idColumns []bool
+}
+
+// xlsx中写成文本的ID列，Excel的数字只保留15位有效数字，较大的uint64 ID会丢失精度
+var xlsxIDColumns = map[string]bool{"id": true, "user_id": true, "bid": true, "fid": true}
+
+// xlsx中除工作表外的固定文件
+var xlsxStaticParts = []struct{ name, body string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Export" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+func newXLSXExportWriter(w io.Writer) exportWriter {
+	x := &xlsxExportWriter{out: w, zw: zip.NewWriter(w)}
+	for _, part := range xlsxStaticParts {
+		f, err := x.zw.Create(part.name)
+		if err != nil {
+			x.err = err
+			return x
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			x.err = err
+			return x
+		}
+	}
+	x.sheet, x.err = x.zw.Create("xl/worksheets/sheet1.xml")
+	if x.err == nil {
+		_, x.err = io.WriteString(x.sheet, xml.Header+`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	}
+	return x
+}
+
+func (x *xlsxExportWriter) WriteHeader(columns []string) error {
+	values := make([]interface{}, len(columns))
+	x.idColumns = make([]bool, len(columns))
+	for i, c := range columns {
+		values[i] = c
+		x.idColumns[i] = xlsxIDColumns[c]
+	}
+	return x.WriteRow(values)
+}
+
+func (x *xlsxExportWriter) WriteRow(values []interface{}) error {
+	if x.err != nil {
+		return x.err
+	}
+	if _, err := io.WriteString(x.sheet, "<row>"); err != nil {
+		return err
+	}
+	for i, v := range values {
+		var err error
+		if i < len(x.idColumns) && x.idColumns[i] {
+			v = fmt.Sprint(v)
+		}
+		switch v := v.(type) {
+		case int, int64, uint64, float64:
+			_, err = fmt.Fprintf(x.sheet, "<c><v>%v</v></c>", v)
+		default:
+			if _, err = io.WriteString(x.sheet, `<c t="inlineStr"><is><t xml:space="preserve">`); err == nil {
+				if err = xml.EscapeText(x.sheet, []byte(fmt.Sprint(v))); err == nil {
+					_, err = io.WriteString(x.sheet, "</t></is></c>")
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(x.sheet, "</row>")
+	return err
+}
+
+func (x *xlsxExportWriter) Flush() error {
+	if x.err != nil {
+		return x.err
+	}
+	return x.zw.Flush()
+}
+
+func (x *xlsxExportWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	if _, err := io.WriteString(x.sheet, "</sheetData></worksheet>"); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// exportView 一个可导出的视图：列名、按查询参数生成的查询，以及把一行结果转换为导出值
+type exportView struct {
+	columns []string
+	query   func(q url.Values) (string, []interface{}, error)
+	scan    func(db *DB, rows *Rows) ([]interface{}, error)
+}
+
+var exportViews = map[string]exportView{
+	// 用户总览，参数: username
+	"users": {
+		columns: []string{"id", "username", "status", "total_files", "total_size_mb", "partitions"},
+		query: func(q url.Values) (string, []interface{}, error) {
+			query, args := userListQuery(q.Get("username"))
+			return query, args, nil
+		},
+		scan: func(db *DB, rows *Rows) ([]interface{}, error) {
+			var u UserStats
+			if err := rows.Scan(&u.ID, &u.Username, &u.Status); err != nil {
+				return nil, err
+			}
+			partitions, err := getUserPartitions(db, BucketCondition{}, u.ID, u.Username, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range partitions {
+				u.TotalFiles += p.Count
+				u.TotalSize += p.Size
+			}
+			return []interface{}{u.ID, u.Username, u.Status, u.TotalFiles, u.TotalSize, uint64(len(partitions))}, nil
+		},
+	},
+	// bucket搜索结果，参数与type=bucket搜索相同: bid, bname, username, limit
+	"buckets": {
+		columns: []string{"user_id", "username", "bid", "bname", "part", "files", "size_mb"},
+		query: func(q url.Values) (string, []interface{}, error) {
+			limit := 0
+			if s := q.Get("limit"); s != "" {
+				l, err := strconv.Atoi(s)
+				if err != nil || l < 0 {
+					return "", nil, fmt.Errorf("invalid limit %q", s)
+				}
+				limit = l
+			}
+			query, args := bucketSearchQuery(q.Get("bid"), q.Get("bname"), q.Get("username"), limit)
+			return query, args, nil
+		},
+		scan: func(db *DB, rows *Rows) ([]interface{}, error) {
+			var (
+				p      PartitionStats
+				status string
+			)
+			if err := rows.Scan(&p.UserID, &p.Username, &status, &p.BID, &p.BName, &p.Part); err != nil {
+				return nil, err
+			}
+			stats, err := getBucketStats(db, p.BID, p.Part)
+			if err != nil {
+				return nil, err
+			}
+			return []interface{}{p.UserID, p.Username, p.BID, p.BName, p.Part, stats.Count, stats.Size}, nil
+		},
+	},
+	// 文件列表，参数与文件页面相同: user, part, fid, fname, bucket，limit为空时不限制条数
+	"files": {
+		columns: []string{"fid", "fname", "bid", "size_mb", "status"},
+		query: func(q url.Values) (string, []interface{}, error) {
+			uid, err := strconv.ParseUint(q.Get("user"), 10, 64)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid user ID")
+			}
+			part := q.Get("part")
+			if !isValidPartition(part) {
+				return "", nil, fmt.Errorf("invalid partition")
+			}
+			var fid, bucketID uint64
+			if s := q.Get("fid"); s != "" {
+				if fid, err = strconv.ParseUint(s, 10, 64); err != nil {
+					return "", nil, fmt.Errorf("invalid file ID")
+				}
+			}
+			if s := q.Get("bucket"); s != "" {
+				if bucketID, err = strconv.ParseUint(s, 10, 64); err != nil {
+					return "", nil, fmt.Errorf("invalid bucket ID")
+				}
+			}
+			query, args := filesQuery(uid, part, fid, q.Get("fname"), bucketID)
+			if s := q.Get("limit"); s != "" {
+				limit, err := strconv.Atoi(s)
+				if err != nil || limit < 0 {
+					return "", nil, fmt.Errorf("invalid limit %q", s)
+				}
+				if limit > 0 {
+					query += " LIMIT ?"
+					args = append(args, limit)
+				}
+			}
+			return query, args, nil
+		},
+		scan: func(db *DB, rows *Rows) ([]interface{}, error) {
+			var f FileInfo
+			if err := rows.Scan(&f.FID, &f.FName, &f.BID, &f.FSize, &f.Status); err != nil {
+				return nil, err
+			}
+			return []interface{}{f.FID, f.FName, f.BID, f.FSize / 1024.0 / 1024, f.Status}, nil
+		},
+	},
+}
+
+// writeExportRows 写出列名和全部行，每exportFlushRows行调用一次flush，返回写出的行数
+func writeExportRows(db *DB, view exportView, rows *Rows, ew exportWriter, flush func() error) (int, error) {
+	count := 0
+	if err := ew.WriteHeader(view.columns); err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		values, err := view.scan(db, rows)
+		if err != nil {
+			return count, err
+		}
+		if err := ew.WriteRow(values); err != nil {
+			return count, err
+		}
+		if count++; flush != nil && count%exportFlushRows == 0 {
+			if err := flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, rows.Err()
+}
+
+// exportHandler 按view和format导出数据，逐行从数据库读取并写出，不在内存中缓存
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling export request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	q := r.URL.Query()
+	view, ok := exportViews[q.Get("view")]
+	if !ok {
+		http.Error(w, "view must be one of users, buckets, files", http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	f, ok := exportFormats[format]
+	if !ok {
+		http.Error(w, "format must be one of csv, ndjson, xlsx", http.StatusBadRequest)
+		return
+	}
+	query, args, err := view.query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	db, release, err := dbManager.Get(r.Context(), dbID)
+	if err != nil {
+		http.Error(w, "Database connection not available: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// 开始写出后无法再返回错误状态码，出错时只记录日志并中断输出
+	filename := fmt.Sprintf("%s_%s_%s.%s", q.Get("view"), dbID, time.Now().Format("20060102_150405"), f.ext)
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	ew := f.newWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	count, err := writeExportRows(db, view, rows, ew, func() error {
+		if err := ew.Flush(); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		slog.WarnContext(r.Context(), "Export aborted", "file", filename, "rows", count, "err", err)
+		return
+	}
+	if err := ew.Close(); err != nil {
+		slog.WarnContext(r.Context(), "Export failed to finish", "file", filename, "err", err)
+		return
+	}
+	slog.DebugContext(r.Context(), "exportHandler completed", "elapsed", time.Since(startTime), "rows", count)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+var (
+	exportTestColumns = []string{"fid", "fname", "bid", "size_mb", "status"}
+	exportTestRows    = [][]interface{}{
+		{uint64(9007199254740993), `a "quoted", <name>.txt`, uint64(123456789012345678), 0.000001, "active"},
+		{uint64(2), "报表.csv", uint64(7), 1536.5, "deleted"},
+	}
+)
+
+// writeExport 用指定格式写出测试数据
+func writeExport(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := exportFormats[format].newWriter(&buf)
+	if err := w.WriteHeader(exportTestColumns); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range exportTestRows {
+		if err := w.WriteRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSVExportWriter(t *testing.T) {
+	want := "fid,fname,bid,size_mb,status\n" +
+		`9007199254740993,"a ""quoted"", <name>.txt",123456789012345678,0.000001,active` + "\n" +
+		"2,报表.csv,7,1536.5,deleted\n"
+	if got := string(writeExport(t, "csv")); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNDJSONExportWriter(t *testing.T) {
+	want := `{"fid":9007199254740993,"fname":"a \"quoted\", \u003cname\u003e.txt","bid":123456789012345678,"size_mb":0.000001,"status":"active"}` + "\n" +
+		`{"fid":2,"fname":"报表.csv","bid":7,"size_mb":1536.5,"status":"deleted"}` + "\n"
+	if got := string(writeExport(t, "ndjson")); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestXLSXExportWriter(t *testing.T) {
+	data := writeExport(t, "xlsx")
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(b)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/worksheets/sheet1.xml"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+
+	// 解析工作表，得到每个单元格的类型和值
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal([]byte(files["xl/worksheets/sheet1.xml"]), &sheet); err != nil {
+		t.Fatal(err)
+	}
+	if len(sheet.Rows) != 3 {
+		t.Fatalf("got %d rows, want header and 2 rows", len(sheet.Rows))
+	}
+	var got [][]string
+	for _, row := range sheet.Rows {
+		var cells []string
+		for _, c := range row.Cells {
+			if c.Type == "inlineStr" {
+				cells = append(cells, "s:"+c.Inline)
+			} else {
+				cells = append(cells, "n:"+c.Value)
+			}
+		}
+		got = append(got, cells)
+	}
+	// ID列写成文本，Excel不会截断超过15位的数字
+	want := [][]string{
+		{"s:fid", "s:fname", "s:bid", "s:size_mb", "s:status"},
+		{"s:9007199254740993", `s:a "quoted", <name>.txt`, "s:123456789012345678", "n:1e-06", "s:active"},
+		{"s:2", "s:报表.csv", "s:7", "n:1536.5", "s:deleted"},
+	}
+	for i := range want {
+		if strings.Join(got[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %d:\ngot  %q\nwant %q", i, got[i], want[i])
+		}
+	}
+}
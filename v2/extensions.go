@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认显示的扩展名数量，其余合并为other
+	defaultExtensionTopN = 20
+	// 没有扩展名的文件
+	noExtension = "(none)"
+	// topN之外合并的扩展名以及未归类的扩展名
+	otherExtension = "(other)"
+	otherCategory  = "other"
+)
+
+// 未配置extension_categories时使用的分类
+var defaultExtensionCategories = map[string][]string{
+	"archives":  {"zip", "rar", "7z", "tar", "gz", "tgz", "bz2", "xz"},
+	"images":    {"png", "jpg", "jpeg", "gif", "bmp", "webp", "svg", "tif", "tiff"},
+	"documents": {"doc", "docx", "xls", "xlsx", "ppt", "pptx", "pdf", "txt", "md", "csv"},
+	"media":     {"mp3", "mp4", "avi", "mkv", "mov", "wav", "flac"},
+	"code":      {"go", "c", "cpp", "h", "java", "py", "js", "ts", "sh", "sql"},
+}
+
+// ExtensionStat 某个扩展名的文件数和大小
+type ExtensionStat struct {
+	Ext      string  `json:"ext"`
+	Category string  `json:"category"`
+	Count    uint64  `json:"count"`
+	Bytes    uint64  `json:"bytes"`
+	Percent  float64 `json:"percent"` // 占总大小的百分比
+}
+
+// CategoryStat 某个分类的文件数和大小
+type CategoryStat struct {
+	Category string  `json:"category"`
+	Count    uint64  `json:"count"`
+	Bytes    uint64  `json:"bytes"`
+	Percent  float64 `json:"percent"`
+}
+
+// ExtensionReport 按扩展名和分类汇总的结果
+type ExtensionReport struct {
+	Scope      string          `json:"scope"` // global, user, bucket
+	Target     string          `json:"target,omitempty"`
+	TotalFiles uint64          `json:"total_files"`
+	TotalBytes uint64          `json:"total_bytes"`
+	Extensions []ExtensionStat `json:"extensions"`
+	Categories []CategoryStat  `json:"categories"`
+	Errors     []string        `json:"errors,omitempty"`
+	Route      *ReadRoute      `json:"read_route,omitempty"`
+}
+
+// extensionCategoryIndex 把分类配置转换为 扩展名->分类
+func extensionCategoryIndex(categories map[string][]string) map[string]string {
+	if len(categories) == 0 {
+		categories = defaultExtensionCategories
+	}
+	index := make(map[string]string)
+	for category, exts := range categories {
+		for _, ext := range exts {
+			index[strings.ToLower(strings.TrimPrefix(ext, "."))] = category
+		}
+	}
+	return index
+}
+
+// extensionQuery 统计分区表中每个扩展名的文件数和大小，扩展名取最后一个'.'之后的部分
+func extensionQuery(part, where string) string {
+	query := fmt.Sprintf(
+		"SELECT LOWER(CASE WHEN LOCATE('.', fname) > 0 THEN SUBSTRING_INDEX(fname, '.', -1) ELSE '' END) AS ext, "+
+			"COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s", part)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	return query + " GROUP BY ext"
+}
+
+// extensionAccumulator 汇总多个分区的扩展名统计
+type extensionAccumulator struct {
+	mu     sync.Mutex
+	counts map[string]*ExtensionStat
+	errors []string
+}
+
+func (a *extensionAccumulator) addPartition(db *DB, part, where string, args ...interface{}) error {
+	rows, err := db.Query(extensionQuery(part, where), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ext string
+		var count, size uint64
+		if err := rows.Scan(&ext, &count, &size); err != nil {
+			return err
+		}
+		if ext == "" {
+			ext = noExtension
+		}
+		a.mu.Lock()
+		stat := a.counts[ext]
+		if stat == nil {
+			stat = &ExtensionStat{Ext: ext}
+			a.counts[ext] = stat
+		}
+		stat.Count += count
+		stat.Bytes += size
+		a.mu.Unlock()
+	}
+	return rows.Err()
+}
+
+// report 归类、排序，并把topN之外的扩展名合并为other
+func (a *extensionAccumulator) report(scope, target string, topN int, categories map[string][]string) *ExtensionReport {
+	report := &ExtensionReport{Scope: scope, Target: target, Errors: a.errors}
+	index := extensionCategoryIndex(categories)
+
+	exts := make([]ExtensionStat, 0, len(a.counts))
+	byCategory := make(map[string]*CategoryStat)
+	for _, stat := range a.counts {
+		stat.Category = index[stat.Ext]
+		if stat.Category == "" {
+			stat.Category = otherCategory
+		}
+		exts = append(exts, *stat)
+		report.TotalFiles += stat.Count
+		report.TotalBytes += stat.Bytes
+
+		c := byCategory[stat.Category]
+		if c == nil {
+			c = &CategoryStat{Category: stat.Category}
+			byCategory[stat.Category] = c
+		}
+		c.Count += stat.Count
+		c.Bytes += stat.Bytes
+	}
+
+	sort.Slice(exts, func(i, j int) bool {
+		if exts[i].Bytes != exts[j].Bytes {
+			return exts[i].Bytes > exts[j].Bytes
+		}
+		return exts[i].Ext < exts[j].Ext
+	})
+	if topN > 0 && len(exts) > topN {
+		other := ExtensionStat{Ext: otherExtension, Category: otherCategory}
+		for _, stat := range exts[topN:] {
+			other.Count += stat.Count
+			other.Bytes += stat.Bytes
+		}
+		exts = append(exts[:topN], other)
+	}
+	for i := range exts {
+		exts[i].Percent = percentOf(exts[i].Bytes, report.TotalBytes)
+	}
+	report.Extensions = exts
+
+	for _, c := range byCategory {
+		c.Percent = percentOf(c.Bytes, report.TotalBytes)
+		report.Categories = append(report.Categories, *c)
+	}
+	sort.Slice(report.Categories, func(i, j int) bool {
+		return report.Categories[i].Bytes > report.Categories[j].Bytes
+	})
+	return report
+}
+
+func percentOf(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// getExtensionStats 按范围统计扩展名：global扫描所有分区，user只扫描用户有bucket的分区，bucket只统计单个bucket
+func getExtensionStats(db *DB, scope string, id uint64, topN int, categories map[string][]string) (*ExtensionReport, error) {
+	acc := &extensionAccumulator{counts: make(map[string]*ExtensionStat)}
+	target := ""
+
+	switch scope {
+	case "bucket":
+		target = strconv.FormatUint(id, 10)
+		var part string
+		if err := db.QueryRow("SELECT part FROM buckets WHERE bid = ?", id).Scan(&part); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("bucket %d not found", id)
+			}
+			return nil, err
+		}
+		if err := acc.addPartition(db, part, "bid = ?", id); err != nil {
+			return nil, err
+		}
+	case "user":
+		target = strconv.FormatUint(id, 10)
+		parts, err := getUserParts(db, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			if err := acc.addPartition(db, part, "bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)", id, part); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		scope = "global"
+		forEachPartition(func(part string) {
+			if err := acc.addPartition(db, part, ""); err != nil {
+				slog.WarnContext(db.ctx, "Extension stats for partition failed", "part", part, "err", err)
+				acc.mu.Lock()
+				acc.errors = append(acc.errors, fmt.Sprintf("partition %s: %v", part, err))
+				acc.mu.Unlock()
+			}
+		})
+		sort.Strings(acc.errors)
+	}
+	return acc.report(scope, target, topN, categories), nil
+}
+
+// extensionsFromRequest 解析scope、user、bucket、top参数并统计，出错时返回HTTP状态码
+func extensionsFromRequest(r *http.Request, dbID string, cfg AppConfig) (*ExtensionReport, int, error) {
+	q := r.URL.Query()
+	topN := defaultExtensionTopN
+	if s := q.Get("top"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid top %q", s)
+		}
+		topN = n
+	}
+
+	scope := q.Get("scope")
+	var id uint64
+	switch scope {
+	case "user", "bucket":
+		var err error
+		id, err = strconv.ParseUint(q.Get(scope), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid %s ID", scope)
+		}
+	case "", "global":
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid scope %q", scope)
+	}
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	report, err := getExtensionStats(db, scope, id, topN, cfg.ExtensionCategories)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	report.Route = &route
+	return report, http.StatusOK, nil
+}
+
+// extensionsHandler 文件类型统计页面
+func extensionsHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling extensions request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	data := map[string]interface{}{
+		"Configs":    cfg.Configs,
+		"SelectedDB": dbID,
+		"Scope":      q.Get("scope"),
+		"User":       q.Get("user"),
+		"Bucket":     q.Get("bucket"),
+		"Top":        q.Get("top"),
+	}
+	if q.Get("run") == "1" {
+		report, cache, status, err := cachedQuery(r, dbID, "extensions", []string{"scope", "user", "bucket", "top"}, func() (*ExtensionReport, int, error) {
+			return extensionsFromRequest(r, dbID, cfg)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		data["Report"] = report
+		data["Cache"] = cache
+		data["ElapsedTime"] = time.Since(startTime).String()
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/extensions.html", "templates/read_route.html", "templates/cache_info.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "extensionsHandler completed", "elapsed", time.Since(startTime))
+}
+
+// extensionsAPIHandler 以JSON返回文件类型统计
+func extensionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+	report, cache, status, err := cachedQuery(r, dbID, "extensions", []string{"scope", "user", "bucket", "top"}, func() (*ExtensionReport, int, error) {
+		return extensionsFromRequest(r, dbID, cfg)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cache.SetHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 未配置时的默认容量目标
+	defaultUserCapacityBytes      uint64 = 1 << 40 // 1TB
+	defaultPartitionCapacityBytes uint64 = 100 << 30
+	// 至少需要多少天的数据才做预测
+	minForecastPoints = 3
+	// 超过这个天数的预测不再给出日期
+	forecastHorizonDays = 3650
+	// 分区页面最多显示的预测条数
+	partitionForecastLimit = 20
+)
+
+// 预测状态
+const (
+	ForecastReached      = "reached"
+	ForecastProjected    = "projected"
+	ForecastNoGrowth     = "no_growth"
+	ForecastBeyond       = "beyond_horizon"
+	ForecastInsufficient = "insufficient_data"
+)
+
+// GrowthPoint 某一天结束时的累计数据量
+type GrowthPoint struct {
+	Date  string `json:"date"`
+	Files uint64 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// Forecast 按created_at做线性或指数拟合，预测达到目标大小的日期
+type Forecast struct {
+	CurrentBytes uint64 `json:"current_bytes"`
+	TargetBytes  uint64 `json:"target_bytes"`
+	Status       string `json:"status"`
+	Model        string `json:"model,omitempty"` // linear 或 exponential
+	// 线性模型为每天增长的字节数，指数模型为每天的增长率
+	DailyGrowth  float64       `json:"daily_growth"`
+	R2           float64       `json:"r2"`
+	ReachedAt    string        `json:"reached_at,omitempty"`
+	DaysToTarget int           `json:"days_to_target,omitempty"`
+	FirstDate    string        `json:"first_date,omitempty"`
+	Points       []GrowthPoint `json:"points,omitempty"`
+	Route        *ReadRoute    `json:"read_route,omitempty"`
+}
+
+// PartitionForecast 单个分区的容量预测
+type PartitionForecast struct {
+	Part string `json:"part"`
+	Forecast
+}
+
+// DailyGrowthPercent 指数模型每天的增长百分比
+func (f Forecast) DailyGrowthPercent() float64 {
+	return f.DailyGrowth * 100
+}
+
+// capacityTargets 返回用户和分区的容量目标，未配置时使用默认值
+func capacityTargets(cfg AppConfig) (user, partition uint64) {
+	user, partition = cfg.UserCapacityBytes, cfg.PartitionCapacityBytes
+	if user == 0 {
+		user = defaultUserCapacityBytes
+	}
+	if partition == 0 {
+		partition = defaultPartitionCapacityBytes
+	}
+	return user, partition
+}
+
+// dailyGrowth 按天汇总一个分区表中新增的文件，where为空时统计整个分区
+func dailyGrowth(db *DB, part, where string, args ...interface{}) (map[string]GrowthPoint, error) {
+	query := fmt.Sprintf("SELECT DATE_FORMAT(created_at, '%%Y-%%m-%%d') d, COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s", part)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " GROUP BY d"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := make(map[string]GrowthPoint)
+	for rows.Next() {
+		var p GrowthPoint
+		if err := rows.Scan(&p.Date, &p.Files, &p.Bytes); err != nil {
+			return nil, err
+		}
+		days[p.Date] = p
+	}
+	return days, rows.Err()
+}
+
+// cumulativePoints 将每天的新增量合并并转换为按日期排序的累计值
+func cumulativePoints(days ...map[string]GrowthPoint) []GrowthPoint {
+	merged := make(map[string]GrowthPoint)
+	for _, m := range days {
+		for date, p := range m {
+			cur := merged[date]
+			cur.Date = date
+			cur.Files += p.Files
+			cur.Bytes += p.Bytes
+			merged[date] = cur
+		}
+	}
+	points := make([]GrowthPoint, 0, len(merged))
+	for _, p := range merged {
+		points = append(points, p)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Date < points[j].Date })
+	for i := 1; i < len(points); i++ {
+		points[i].Files += points[i-1].Files
+		points[i].Bytes += points[i-1].Bytes
+	}
+	return points
+}
+
+// getUserGrowth 用户在所有分区中每天的累计数据量
+func getUserGrowth(db *DB, userID uint64) ([]GrowthPoint, error) {
+	parts, err := getUserParts(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	var days []map[string]GrowthPoint
+	for _, part := range parts {
+		m, err := dailyGrowth(db, part, "bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)", userID, part)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", part, err)
+		}
+		days = append(days, m)
+	}
+	return cumulativePoints(days...), nil
+}
+
+// getPartitionGrowth 分区每天的累计数据量
+func getPartitionGrowth(db *DB, part string) ([]GrowthPoint, error) {
+	m, err := dailyGrowth(db, part, "")
+	if err != nil {
+		return nil, err
+	}
+	return cumulativePoints(m), nil
+}
+
+// forecastGrowth 分别做线性和指数最小二乘拟合，选R²较高的模型预测达到target的日期
+func forecastGrowth(points []GrowthPoint, target uint64, now time.Time) Forecast {
+	f := Forecast{TargetBytes: target, Status: ForecastInsufficient, Points: points}
+	if len(points) == 0 {
+		return f
+	}
+	f.CurrentBytes = points[len(points)-1].Bytes
+	f.FirstDate = points[0].Date
+	if f.CurrentBytes >= target {
+		f.Status = ForecastReached
+		return f
+	}
+	if len(points) < minForecastPoints {
+		return f
+	}
+
+	first, err := time.Parse("2006-01-02", points[0].Date)
+	if err != nil {
+		return f
+	}
+	xs := make([]float64, 0, len(points))
+	ys := make([]float64, 0, len(points))
+	logs := make([]float64, 0, len(points))
+	for _, p := range points {
+		d, err := time.Parse("2006-01-02", p.Date)
+		if err != nil {
+			return f
+		}
+		xs = append(xs, d.Sub(first).Hours()/24)
+		ys = append(ys, float64(p.Bytes))
+		logs = append(logs, math.Log(math.Max(float64(p.Bytes), 1)))
+	}
+
+	// 线性: y = a + b*x
+	a, b := leastSquares(xs, ys)
+	f.Model, f.DailyGrowth = "linear", b
+	f.R2 = rSquared(xs, ys, func(x float64) float64 { return a + b*x })
+	days := math.Inf(1)
+	if b > 0 {
+		days = (float64(target) - a) / b
+	}
+
+	// 指数: ln y = la + lb*x
+	la, lb := leastSquares(xs, logs)
+	if lb > 0 {
+		r2 := rSquared(xs, ys, func(x float64) float64 { return math.Exp(la + lb*x) })
+		if r2 > f.R2 {
+			f.Model, f.DailyGrowth, f.R2 = "exponential", math.Exp(lb)-1, r2
+			days = (math.Log(float64(target)) - la) / lb
+		}
+	}
+
+	if math.IsInf(days, 1) || math.IsNaN(days) {
+		f.Status = ForecastNoGrowth
+		return f
+	}
+	// 先按天数判断是否超出预测范围，再换算为日期，避免换算为time.Duration时溢出
+	today := now.Truncate(24 * time.Hour)
+	days -= today.Sub(first).Hours() / 24
+	if days > forecastHorizonDays {
+		f.Status = ForecastBeyond
+		return f
+	}
+	// 拟合结果早于今天时说明近期增长放缓，按今天计
+	if days < 0 {
+		days = 0
+	}
+	f.DaysToTarget = int(math.Ceil(days))
+	reached := today.AddDate(0, 0, f.DaysToTarget)
+	f.Status = ForecastProjected
+	f.ReachedAt = reached.Format("2006-01-02")
+	return f
+}
+
+// leastSquares 最小二乘拟合 y = a + b*x
+func leastSquares(xs, ys []float64) (a, b float64) {
+	n := float64(len(xs))
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	denom := n*sxx - sx*sx
+	if denom == 0 {
+		return sy / n, 0
+	}
+	b = (n*sxy - sx*sy) / denom
+	a = (sy - b*sx) / n
+	return a, b
+}
+
+// rSquared 在原始数据上计算拟合优度，便于比较线性和指数模型
+func rSquared(xs, ys []float64, fit func(float64) float64) float64 {
+	var mean float64
+	for _, y := range ys {
+		mean += y
+	}
+	mean /= float64(len(ys))
+	var ssRes, ssTot float64
+	for i := range xs {
+		ssRes += (ys[i] - fit(xs[i])) * (ys[i] - fit(xs[i]))
+		ssTot += (ys[i] - mean) * (ys[i] - mean)
+	}
+	if ssTot == 0 {
+		return 0
+	}
+	return 1 - ssRes/ssTot
+}
+
+// getPartitionForecasts 预测所有分区达到target的日期，按到达时间排序
+func getPartitionForecasts(db *DB, target uint64) ([]PartitionForecast, []string) {
+	var (
+		mu        sync.Mutex
+		forecasts []PartitionForecast
+		errs      []string
+	)
+	now := time.Now()
+	forEachPartition(func(part string) {
+		points, err := getPartitionGrowth(db, part)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("partition %s growth: %v", part, err))
+			return
+		}
+		f := forecastGrowth(points, target, now)
+		f.Points = nil
+		forecasts = append(forecasts, PartitionForecast{Part: part, Forecast: f})
+	})
+	sort.Slice(forecasts, func(i, j int) bool { return forecastLess(forecasts[i].Forecast, forecasts[j].Forecast) })
+	sort.Strings(errs)
+	return forecasts, errs
+}
+
+// forecastLess 已达到目标的排在最前，其次按预测日期，其余按当前大小
+func forecastLess(a, b Forecast) bool {
+	rank := func(f Forecast) int {
+		switch f.Status {
+		case ForecastReached:
+			return 0
+		case ForecastProjected:
+			return 1
+		}
+		return 2
+	}
+	if rank(a) != rank(b) {
+		return rank(a) < rank(b)
+	}
+	if a.Status == ForecastProjected && a.ReachedAt != b.ReachedAt {
+		return a.ReachedAt < b.ReachedAt
+	}
+	return a.CurrentBytes > b.CurrentBytes
+}
+
+// forecastFromRequest 按user或part参数计算预测
+func forecastFromRequest(r *http.Request, dbID string, cfg AppConfig) (*Forecast, int, error) {
+	q := r.URL.Query()
+	userTarget, partTarget := capacityTargets(cfg)
+
+	// 先校验参数，再获取连接
+	var (
+		query  func(db *DB) ([]GrowthPoint, error)
+		target uint64
+	)
+	switch {
+	case q.Get("user") != "":
+		uid, err := strconv.ParseUint(q.Get("user"), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid user ID")
+		}
+		query = func(db *DB) ([]GrowthPoint, error) { return getUserGrowth(db, uid) }
+		target = userTarget
+	case q.Get("part") != "":
+		part := q.Get("part")
+		if !isValidPartition(part) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid partition")
+		}
+		query = func(db *DB) ([]GrowthPoint, error) { return getPartitionGrowth(db, part) }
+		target = partTarget
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("one of user or part is required")
+	}
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	points, err := query(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	f := forecastGrowth(points, target, time.Now())
+	f.Route = &route
+	return &f, http.StatusOK, nil
+}
+
+// forecastHandler 返回容量预测的页面片段，供用户统计页面通过AJAX加载
+func forecastHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling forecast request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+	f, cache, status, err := cachedQuery(r, dbID, "forecast", []string{"user", "part"}, func() (*Forecast, int, error) {
+		return forecastFromRequest(r, dbID, cfg)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/forecast_content.html", "templates/read_route.html", "templates/cache_info.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// 预测结果只作为页面片段加载，不提供刷新链接
+	cache.RefreshURL = ""
+	if err := tmpl.Execute(w, map[string]interface{}{
+		"Forecast": f,
+		"Cache":    cache,
+		"User":     r.URL.Query().Get("user"),
+		"Part":     r.URL.Query().Get("part"),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "forecastHandler completed", "elapsed", time.Since(startTime))
+}
+
+// forecastAPIHandler 以JSON返回容量预测
+func forecastAPIHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+	f, cache, status, err := cachedQuery(r, dbID, "forecast", []string{"user", "part"}, func() (*Forecast, int, error) {
+		return forecastFromRequest(r, dbID, cfg)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cache.SetHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// dailyPoints 从2024-01-01开始每天一个点
+func dailyPoints(bytes ...uint64) []GrowthPoint {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	points := make([]GrowthPoint, len(bytes))
+	for i, b := range bytes {
+		points[i] = GrowthPoint{Date: start.AddDate(0, 0, i).Format("2006-01-02"), Bytes: b}
+	}
+	return points
+}
+
+func TestForecastGrowth(t *testing.T) {
+	linear := dailyPoints(1000, 1100, 1200, 1300, 1400, 1500, 1600, 1700, 1800, 1900)
+	doubling := dailyPoints(1, 2, 4, 8, 16, 32, 64, 128, 256, 512)
+	jan10 := time.Date(2024, 1, 10, 15, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		points     []GrowthPoint
+		target     uint64
+		now        time.Time
+		wantStatus string
+		wantModel  string
+		wantDate   string
+		wantDays   int
+	}{
+		{name: "no data", target: 100, now: jan10, wantStatus: ForecastInsufficient},
+		{name: "already reached", points: dailyPoints(50, 150), target: 100, now: jan10, wantStatus: ForecastReached},
+		{name: "too few points", points: dailyPoints(10, 20), target: 100, now: jan10, wantStatus: ForecastInsufficient},
+		{name: "no growth", points: dailyPoints(10, 10, 10, 10), target: 100, now: jan10, wantStatus: ForecastNoGrowth, wantModel: "linear"},
+		{name: "shrinking", points: dailyPoints(40, 30, 20, 10), target: 100, now: jan10, wantStatus: ForecastNoGrowth, wantModel: "linear"},
+		{
+			name: "linear", points: linear, target: 3000, now: jan10,
+			wantStatus: ForecastProjected, wantModel: "linear", wantDate: "2024-01-21", wantDays: 11,
+		},
+		{
+			name: "exponential", points: doubling, target: 4096, now: jan10,
+			wantStatus: ForecastProjected, wantModel: "exponential", wantDate: "2024-01-13", wantDays: 3,
+		},
+		{
+			// 拟合的日期已经过去，按今天计
+			name: "projected date in the past", points: linear, target: 3000, now: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+			wantStatus: ForecastProjected, wantModel: "linear", wantDate: "2024-03-01", wantDays: 0,
+		},
+		{
+			name: "beyond horizon", points: linear, target: 100 << 30, now: jan10,
+			wantStatus: ForecastBeyond, wantModel: "linear",
+		},
+		{
+			// 天数远超time.Duration的范围，不能溢出成过去的日期
+			name: "beyond duration range", points: dailyPoints(1000, 1001, 1002, 1003), target: math.MaxUint64, now: jan10,
+			wantStatus: ForecastBeyond, wantModel: "linear",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := forecastGrowth(tt.points, tt.target, tt.now)
+			if f.Status != tt.wantStatus {
+				t.Fatalf("status = %s, want %s (%+v)", f.Status, tt.wantStatus, f)
+			}
+			if f.Model != tt.wantModel {
+				t.Errorf("model = %q, want %q", f.Model, tt.wantModel)
+			}
+			if f.ReachedAt != tt.wantDate || f.DaysToTarget != tt.wantDays {
+				t.Errorf("reached %q in %d days, want %q in %d days", f.ReachedAt, f.DaysToTarget, tt.wantDate, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestLeastSquares(t *testing.T) {
+	a, b := leastSquares([]float64{0, 1, 2, 3}, []float64{1, 3, 5, 7})
+	if math.Abs(a-1) > 1e-9 || math.Abs(b-2) > 1e-9 {
+		t.Errorf("got a=%v b=%v, want a=1 b=2", a, b)
+	}
+}
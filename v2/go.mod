@@ -2,4 +2,7 @@ module simple_web_tool
 
 go 1.21
 
-require github.com/go-sql-driver/mysql v1.7.1
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/go-sql-driver/mysql v1.7.1
+)
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 单次健康检查的超时时间
+const healthCheckTimeout = 10 * time.Second
+
+// SchemaStatus 期望的表结构是否存在：users、buckets 以及 bucket_files_00~ff
+type SchemaStatus struct {
+	UsersTable        bool     `json:"users_table"`
+	BucketsTable      bool     `json:"buckets_table"`
+	PartitionTables   int      `json:"partition_tables"`
+	MissingPartitions []string `json:"missing_partitions,omitempty"`
+}
+
+func (s SchemaStatus) OK() bool {
+	return s.UsersTable && s.BucketsTable && len(s.MissingPartitions) == 0
+}
+
+// DBHealth 单个数据库配置的健康状态
+type DBHealth struct {
+	ID          string       `json:"id"`
+	Description string       `json:"description,omitempty"`
+	Addr        string       `json:"addr"`
+	OK          bool         `json:"ok"`
+	LatencyMs   float64      `json:"latency_ms"`
+	Version     string       `json:"version,omitempty"`
+	Schema      SchemaStatus `json:"schema"`
+	// 连接池统计，连接池未打开时为空
+	PoolOpen    bool        `json:"pool_open"`
+	PoolStats   sql.DBStats `json:"pool_stats"`
+	LastError   string      `json:"last_error,omitempty"`
+	LastErrorAt time.Time   `json:"last_error_at,omitempty"`
+	CheckedAt   time.Time   `json:"checked_at"`
+	// 从库的状态和复制延迟
+	Replicas []ReplicaHealth `json:"replicas,omitempty"`
+}
+
+// HealthMonitor 定期检查所有配置的数据库，保存最近一次的结果
+type HealthMonitor struct {
+	interval time.Duration
+
+	mu        sync.RWMutex
+	results   map[string]DBHealth
+	checkedAt time.Time // 最近一次检查完成的时间
+
+	// refreshMu 串行化页面触发的检查
+	refreshMu sync.Mutex
+}
+
+// 页面refresh=1触发检查的最小间隔，避免频繁刷新时反复连接所有数据库
+const minHealthRefreshInterval = 5 * time.Second
+
+func NewHealthMonitor(interval time.Duration) *HealthMonitor {
+	return &HealthMonitor{
+		interval: interval,
+		results:  make(map[string]DBHealth),
+	}
+}
+
+// Run 立即检查一次，之后按interval定期检查，直到stop关闭
+func (h *HealthMonitor) Run(stop <-chan struct{}) {
+	h.CheckAll()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.CheckAll()
+		}
+	}
+}
+
+// CheckAll 并发检查当前配置中的所有数据库
+func (h *HealthMonitor) CheckAll() {
+	cfg := getAppConfig()
+
+	var wg sync.WaitGroup
+	results := make(chan DBHealth, len(cfg.Configs))
+	for _, c := range cfg.Configs {
+		wg.Add(1)
+		go func(c Config) {
+			defer wg.Done()
+			results <- h.check(c)
+		}(c)
+	}
+	wg.Wait()
+	close(results)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := make(map[string]DBHealth)
+	for res := range results {
+		// 保留上一次的错误信息，便于查看间歇性故障
+		if res.LastError == "" {
+			if prev, ok := h.results[res.ID]; ok {
+				res.LastError, res.LastErrorAt = prev.LastError, prev.LastErrorAt
+			}
+		}
+		current[res.ID] = res
+	}
+	h.results = current
+	h.checkedAt = time.Now()
+}
+
+// Refresh 立即检查所有数据库，距上次检查不足minHealthRefreshInterval时直接使用上次的结果
+func (h *HealthMonitor) Refresh() {
+	h.refreshMu.Lock()
+	defer h.refreshMu.Unlock()
+	h.mu.RLock()
+	recent := time.Since(h.checkedAt) < minHealthRefreshInterval
+	h.mu.RUnlock()
+	if recent {
+		return
+	}
+	h.CheckAll()
+}
+
+// ReplicaHealth 返回指定数据库最近一次检查的从库状态
+func (h *HealthMonitor) ReplicaHealth(id string) []ReplicaHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.results[id].Replicas
+}
+
+// Snapshot 按配置顺序返回最近一次的检查结果，尚未检查的配置只有基本信息
+func (h *HealthMonitor) Snapshot(cfg AppConfig) []DBHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	list := make([]DBHealth, 0, len(cfg.Configs))
+	for _, c := range cfg.Configs {
+		res, ok := h.results[c.ID]
+		if !ok {
+			res = DBHealth{ID: c.ID, Description: c.Description, Addr: configAddr(c)}
+		}
+		list = append(list, res)
+	}
+	return list
+}
+
+// check 使用独立的临时连接检查数据库，不影响连接池的空闲回收
+func (h *HealthMonitor) check(c Config) DBHealth {
+	res := DBHealth{
+		ID:          c.ID,
+		Description: c.Description,
+		Addr:        configAddr(c),
+		CheckedAt:   time.Now(),
+	}
+	res.PoolStats, res.PoolOpen = dbManager.Stats(c.ID)
+	// 从库和主库的检查互不影响
+	res.Replicas = checkReplicas(c)
+
+	fail := func(err error) DBHealth {
+		slog.Warn("Health check for database failed", "db", c.ID, "err", err)
+		res.OK = false
+		res.LastError = err.Error()
+		res.LastErrorAt = res.CheckedAt
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	db, err := connectDB(c)
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return fail(err)
+	}
+
+	// 连接建立后再计时，只统计一次查询的往返时间
+	start := time.Now()
+	if err := db.QueryRowContext(ctx, "SELECT VERSION()").Scan(&res.Version); err != nil {
+		return fail(err)
+	}
+	res.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+
+	schema, err := checkSchema(ctx, db)
+	if err != nil {
+		return fail(err)
+	}
+	res.Schema = schema
+	res.OK = schema.OK()
+	return res
+}
+
+// checkSchema 检查当前库中是否存在期望的表
+func checkSchema(ctx context.Context, db *sql.DB) (SchemaStatus, error) {
+	var status SchemaStatus
+	rows, err := db.QueryContext(ctx,
+		"SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() "+
+			"AND (table_name IN ('users', 'buckets') OR table_name LIKE 'bucket\\_files\\_%')")
+	if err != nil {
+		return status, err
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return status, err
+		}
+		tables[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return status, err
+	}
+
+	status.UsersTable = tables["users"]
+	status.BucketsTable = tables["buckets"]
+	for _, part := range allPartitions() {
+		if tables["bucket_files_"+part] {
+			status.PartitionTables++
+		} else {
+			status.MissingPartitions = append(status.MissingPartitions, part)
+		}
+	}
+	return status, nil
+}
+
+func configAddr(c Config) string {
+	return c.Host + ":" + c.Port + "/" + c.DBName
+}
+
+// statusHandler 数据库状态页面
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	slog.DebugContext(r.Context(), "Handling status request", "clientip", r.RemoteAddr, "method", r.Method)
+	if r.URL.Query().Get("refresh") == "1" {
+		healthMonitor.Refresh()
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/status.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, map[string]interface{}{
+		"Databases": healthMonitor.Snapshot(getAppConfig()),
+		"Cache":     queryCache.Stats(),
+		"Interval":  healthMonitor.interval.String(),
+		"RefreshMs": healthMonitor.interval.Milliseconds(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// healthAPIHandler 以JSON返回所有数据库的健康状态
+func healthAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("refresh") == "1" {
+		healthMonitor.Refresh()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"databases": healthMonitor.Snapshot(getAppConfig()),
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthMonitorRefresh(t *testing.T) {
+	h := NewHealthMonitor(time.Minute)
+	h.Refresh()
+	first := h.checkedAt
+	if first.IsZero() {
+		t.Fatal("first refresh did not check")
+	}
+	h.Refresh()
+	if !h.checkedAt.Equal(first) {
+		t.Error("refresh within the minimum interval checked again")
+	}
+
+	h.checkedAt = time.Now().Add(-minHealthRefreshInterval)
+	h.Refresh()
+	if !h.checkedAt.After(first) {
+		t.Error("refresh after the minimum interval did not check")
+	}
+}
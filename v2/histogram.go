@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistogramBin 文件大小区间，Max为0表示没有上限
+type HistogramBin struct {
+	Label        string  `json:"label"`
+	Min          uint64  `json:"min"`
+	Max          uint64  `json:"max,omitempty"`
+	Count        uint64  `json:"count"`
+	Bytes        uint64  `json:"bytes"`
+	CountPercent float64 `json:"count_percent"`
+	BytesPercent float64 `json:"bytes_percent"`
+}
+
+// SizeHistogram 按对数区间统计的文件大小分布
+type SizeHistogram struct {
+	Scope      string         `json:"scope"` // user, bucket, partition
+	Target     string         `json:"target"`
+	TotalFiles uint64         `json:"total_files"`
+	TotalBytes uint64         `json:"total_bytes"`
+	Bins       []HistogramBin `json:"bins"`
+	Route      *ReadRoute     `json:"read_route,omitempty"`
+}
+
+// 对数刻度的大小区间
+var sizeBins = []HistogramBin{
+	{Label: "0-4KB", Min: 0, Max: 4 << 10},
+	{Label: "4KB-1MB", Min: 4 << 10, Max: 1 << 20},
+	{Label: "1MB-100MB", Min: 1 << 20, Max: 100 << 20},
+	{Label: "100MB-1GB", Min: 100 << 20, Max: 1 << 30},
+	{Label: "1GB-10GB", Min: 1 << 30, Max: 10 << 30},
+	{Label: ">=10GB", Min: 10 << 30},
+}
+
+func newSizeHistogram(scope, target string) *SizeHistogram {
+	h := &SizeHistogram{Scope: scope, Target: target}
+	h.Bins = make([]HistogramBin, len(sizeBins))
+	copy(h.Bins, sizeBins)
+	return h
+}
+
+// histogramColumns 生成每个区间的文件数和字节数的聚合列
+func histogramColumns() string {
+	cols := make([]string, 0, len(sizeBins)*2)
+	for _, b := range sizeBins {
+		cond := fmt.Sprintf("fsize >= %d", b.Min)
+		if b.Max > 0 {
+			cond += fmt.Sprintf(" AND fsize < %d", b.Max)
+		}
+		cols = append(cols,
+			fmt.Sprintf("COALESCE(SUM(CASE WHEN %s THEN 1 ELSE 0 END), 0)", cond),
+			fmt.Sprintf("COALESCE(SUM(CASE WHEN %s THEN fsize ELSE 0 END), 0)", cond))
+	}
+	return strings.Join(cols, ", ")
+}
+
+// addPartition 统计分区表中满足条件的文件，累加到h中
+func (h *SizeHistogram) addPartition(db *DB, part, where string, args ...interface{}) error {
+	query := fmt.Sprintf("SELECT %s FROM bucket_files_%s", histogramColumns(), part)
+	if where != "" {
+		query += " WHERE " + where
+	}
+
+	values := make([]uint64, len(sizeBins)*2)
+	dest := make([]interface{}, len(values))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := db.QueryRow(query, args...).Scan(dest...); err != nil {
+		return fmt.Errorf("failed to scan histogram of partition %s: %w", part, err)
+	}
+	for i := range h.Bins {
+		h.Bins[i].Count += values[i*2]
+		h.Bins[i].Bytes += values[i*2+1]
+		h.TotalFiles += values[i*2]
+		h.TotalBytes += values[i*2+1]
+	}
+	return nil
+}
+
+// finish 计算各区间的占比，用于绘制柱状图
+func (h *SizeHistogram) finish() *SizeHistogram {
+	for i := range h.Bins {
+		if h.TotalFiles > 0 {
+			h.Bins[i].CountPercent = float64(h.Bins[i].Count) * 100 / float64(h.TotalFiles)
+		}
+		if h.TotalBytes > 0 {
+			h.Bins[i].BytesPercent = float64(h.Bins[i].Bytes) * 100 / float64(h.TotalBytes)
+		}
+	}
+	return h
+}
+
+// getUserHistogram 用户所有分区的文件大小分布
+func getUserHistogram(db *DB, userID uint64) (*SizeHistogram, error) {
+	h := newSizeHistogram("user", strconv.FormatUint(userID, 10))
+	parts, err := getUserParts(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, part := range parts {
+		if err := h.addPartition(db, part, "bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)", userID, part); err != nil {
+			return nil, err
+		}
+	}
+	return h.finish(), nil
+}
+
+// getBucketHistogram 单个bucket的文件大小分布
+func getBucketHistogram(db *DB, bid uint64) (*SizeHistogram, error) {
+	var part string
+	if err := db.QueryRow("SELECT part FROM buckets WHERE bid = ?", bid).Scan(&part); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("bucket %d not found", bid)
+		}
+		return nil, err
+	}
+	h := newSizeHistogram("bucket", strconv.FormatUint(bid, 10))
+	if err := h.addPartition(db, part, "bid = ?", bid); err != nil {
+		return nil, err
+	}
+	return h.finish(), nil
+}
+
+// getPartitionHistogram 整个分区表的文件大小分布
+func getPartitionHistogram(db *DB, part string) (*SizeHistogram, error) {
+	if !isValidPartition(part) {
+		return nil, fmt.Errorf("invalid partition %q", part)
+	}
+	h := newSizeHistogram("partition", part)
+	if err := h.addPartition(db, part, ""); err != nil {
+		return nil, err
+	}
+	return h.finish(), nil
+}
+
+// isValidPartition 分区号必须是两位小写十六进制，防止拼接表名时注入
+func isValidPartition(part string) bool {
+	if len(part) != 2 {
+		return false
+	}
+	for _, c := range part {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// histogramFromRequest 根据user、bucket、part参数计算对应的分布，出错时返回HTTP状态码
+func histogramFromRequest(r *http.Request, dbID string) (*SizeHistogram, int, error) {
+	q := r.URL.Query()
+
+	// 先校验参数，再获取连接
+	var query func(db *DB) (*SizeHistogram, error)
+	switch {
+	case q.Get("bucket") != "":
+		bid, err := strconv.ParseUint(q.Get("bucket"), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid bucket ID")
+		}
+		query = func(db *DB) (*SizeHistogram, error) { return getBucketHistogram(db, bid) }
+	case q.Get("user") != "":
+		uid, err := strconv.ParseUint(q.Get("user"), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid user ID")
+		}
+		query = func(db *DB) (*SizeHistogram, error) { return getUserHistogram(db, uid) }
+	case q.Get("part") != "":
+		part := q.Get("part")
+		if !isValidPartition(part) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid partition")
+		}
+		query = func(db *DB) (*SizeHistogram, error) { return getPartitionHistogram(db, part) }
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("one of user, bucket or part is required")
+	}
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	h, err := query(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	h.Route = &route
+	return h, http.StatusOK, nil
+}
+
+// histogramHandler 文件大小分布图，AJAX请求只返回图表部分
+func histogramHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling histogram request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Configs":    cfg.Configs,
+		"SelectedDB": dbID,
+		"User":       r.URL.Query().Get("user"),
+		"Bucket":     r.URL.Query().Get("bucket"),
+		"Part":       r.URL.Query().Get("part"),
+	}
+	q := r.URL.Query()
+	if q.Get("user") != "" || q.Get("bucket") != "" || q.Get("part") != "" {
+		h, cache, status, err := cachedQuery(r, dbID, "histogram", []string{"user", "bucket", "part"}, func() (*SizeHistogram, int, error) {
+			return histogramFromRequest(r, dbID)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		data["Histogram"] = h
+		data["Cache"] = cache
+	}
+	data["ElapsedTime"] = time.Since(startTime).String()
+
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		tmpl, err := template.ParseFS(templates, "templates/histogram_content.html", "templates/read_route.html", "templates/cache_info.html")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tmpl.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/histogram.html", "templates/histogram_content.html", "templates/read_route.html", "templates/cache_info.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "histogramHandler completed", "elapsed", time.Since(startTime))
+}
+
+// histogramAPIHandler 以JSON返回文件大小分布
+func histogramAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	h, cache, status, err := cachedQuery(r, dbID, "histogram", []string{"user", "bucket", "part"}, func() (*SizeHistogram, int, error) {
+		return histogramFromRequest(r, dbID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cache.SetHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h)
+}
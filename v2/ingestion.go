@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// 默认统计最近30天
+	defaultIngestionDays = 30
+	// 时间段数量上限，防止按小时统计很长的区间
+	maxIngestionPoints = 2000
+	// 超过均值多少个标准差视为突增
+	defaultSpikeThreshold = 3.0
+)
+
+// ingestionGranularity 统计粒度对应的MySQL格式、Go格式和步长
+type ingestionGranularity struct {
+	sqlFormat string
+	layout    string
+	next      func(time.Time) time.Time
+	truncate  func(time.Time) time.Time
+}
+
+var ingestionGranularities = map[string]ingestionGranularity{
+	"hour": {
+		sqlFormat: "%Y-%m-%d %H:00",
+		layout:    "2006-01-02 15:00",
+		next:      func(t time.Time) time.Time { return t.Add(time.Hour) },
+		truncate:  func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+	},
+	"day": {
+		sqlFormat: "%Y-%m-%d",
+		layout:    "2006-01-02",
+		next:      func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		},
+	},
+	"month": {
+		sqlFormat: "%Y-%m",
+		layout:    "2006-01",
+		next:      func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+		truncate: func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		},
+	},
+}
+
+// IngestionPoint 一个时间段内新增的文件
+type IngestionPoint struct {
+	Period string  `json:"period"`
+	Files  uint64  `json:"files"`
+	Bytes  uint64  `json:"bytes"`
+	Spike  bool    `json:"spike"`
+	Heat   float64 `json:"-"` // 柱状图高度，0~100
+}
+
+// IngestionReport 按时间统计的新增文件
+type IngestionReport struct {
+	Scope       string           `json:"scope"` // user 或 bucket
+	Target      uint64           `json:"target"`
+	Granularity string           `json:"granularity"`
+	From        string           `json:"from"`
+	To          string           `json:"to"`
+	Threshold   float64          `json:"threshold"`
+	TotalFiles  uint64           `json:"total_files"`
+	TotalBytes  uint64           `json:"total_bytes"`
+	Points      []IngestionPoint `json:"points"`
+	Spikes      []IngestionPoint `json:"spikes"`
+	Route       *ReadRoute       `json:"read_route,omitempty"`
+}
+
+// IngestionRange 查询区间[From, To)和统计粒度
+type IngestionRange struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+	Threshold   float64
+}
+
+// addPartition 统计一个分区表中的新增文件，where为bid的过滤条件
+func (r *IngestionReport) addPartition(db *DB, rng IngestionRange, counts map[string]*IngestionPoint, part, where string, args ...interface{}) error {
+	g := ingestionGranularities[rng.Granularity]
+	query := fmt.Sprintf("SELECT DATE_FORMAT(created_at, '%s') t, COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s "+
+		"WHERE %s AND created_at >= ? AND created_at < ? GROUP BY t", g.sqlFormat, part, where)
+	args = append(args, rng.From.Format("2006-01-02 15:04:05"), rng.To.Format("2006-01-02 15:04:05"))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			period       string
+			files, bytes uint64
+		)
+		if err := rows.Scan(&period, &files, &bytes); err != nil {
+			return err
+		}
+		if p, ok := counts[period]; ok {
+			p.Files += files
+			p.Bytes += bytes
+		}
+	}
+	return rows.Err()
+}
+
+// newIngestionReport 生成区间内所有时间段，没有数据的时间段为0
+func newIngestionReport(scope string, target uint64, rng IngestionRange) (*IngestionReport, map[string]*IngestionPoint) {
+	g := ingestionGranularities[rng.Granularity]
+	r := &IngestionReport{
+		Scope:       scope,
+		Target:      target,
+		Granularity: rng.Granularity,
+		From:        rng.From.Format("2006-01-02"),
+		To:          rng.To.AddDate(0, 0, -1).Format("2006-01-02"),
+		Threshold:   rng.Threshold,
+	}
+	for t := g.truncate(rng.From); t.Before(rng.To); t = g.next(t) {
+		r.Points = append(r.Points, IngestionPoint{Period: t.Format(g.layout)})
+	}
+	counts := make(map[string]*IngestionPoint, len(r.Points))
+	for i := range r.Points {
+		counts[r.Points[i].Period] = &r.Points[i]
+	}
+	return r, counts
+}
+
+// finish 计算合计、柱状图高度，并按文件数或字节数的z-score标记突增
+func (r *IngestionReport) finish() {
+	var maxBytes uint64
+	files := make([]float64, len(r.Points))
+	bytes := make([]float64, len(r.Points))
+	for i, p := range r.Points {
+		r.TotalFiles += p.Files
+		r.TotalBytes += p.Bytes
+		maxBytes = max(maxBytes, p.Bytes)
+		files[i] = float64(p.Files)
+		bytes[i] = float64(p.Bytes)
+	}
+	fileSpike := spikeLimit(files, r.Threshold)
+	byteSpike := spikeLimit(bytes, r.Threshold)
+	for i := range r.Points {
+		p := &r.Points[i]
+		p.Heat = ratio(p.Bytes, maxBytes) * 100
+		p.Spike = float64(p.Files) > fileSpike || float64(p.Bytes) > byteSpike
+		if p.Spike {
+			r.Spikes = append(r.Spikes, *p)
+		}
+	}
+}
+
+// spikeLimit 返回 均值+threshold*标准差，数据没有波动时返回+Inf
+func spikeLimit(values []float64, threshold float64) float64 {
+	s := skewStats(values)
+	if s.StdDev == 0 {
+		return math.Inf(1)
+	}
+	return s.Mean + threshold*s.StdDev
+}
+
+// getUserIngestion 用户在所有分区中按时间统计的新增文件
+func getUserIngestion(db *DB, userID uint64, rng IngestionRange) (*IngestionReport, error) {
+	parts, err := getUserParts(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	r, counts := newIngestionReport("user", userID, rng)
+	for _, part := range parts {
+		if err := r.addPartition(db, rng, counts, part, "bid IN (SELECT bid FROM buckets WHERE user = ? AND part = ?)", userID, part); err != nil {
+			return nil, fmt.Errorf("partition %s: %w", part, err)
+		}
+	}
+	r.finish()
+	return r, nil
+}
+
+// getBucketIngestion bucket按时间统计的新增文件
+func getBucketIngestion(db *DB, bid uint64, rng IngestionRange) (*IngestionReport, error) {
+	var part string
+	if err := db.QueryRow("SELECT part FROM buckets WHERE bid = ?", bid).Scan(&part); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("bucket %d not found", bid)
+		}
+		return nil, err
+	}
+	r, counts := newIngestionReport("bucket", bid, rng)
+	if err := r.addPartition(db, rng, counts, part, "bid = ?", bid); err != nil {
+		return nil, err
+	}
+	r.finish()
+	return r, nil
+}
+
+// ingestionRangeFromRequest 解析from、to(包含当天)、granularity和threshold参数
+func ingestionRangeFromRequest(r *http.Request) (IngestionRange, error) {
+	q := r.URL.Query()
+	rng := IngestionRange{Granularity: q.Get("granularity"), Threshold: defaultSpikeThreshold}
+	if rng.Granularity == "" {
+		rng.Granularity = "day"
+	}
+	g, ok := ingestionGranularities[rng.Granularity]
+	if !ok {
+		return rng, fmt.Errorf("invalid granularity %q", rng.Granularity)
+	}
+
+	today := ingestionGranularities["day"].truncate(time.Now())
+	rng.To = today.AddDate(0, 0, 1)
+	if s := q.Get("to"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return rng, fmt.Errorf("invalid to date %q", s)
+		}
+		rng.To = t.AddDate(0, 0, 1)
+	}
+	rng.From = rng.To.AddDate(0, 0, -defaultIngestionDays)
+	if s := q.Get("from"); s != "" {
+		t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			return rng, fmt.Errorf("invalid from date %q", s)
+		}
+		rng.From = t
+	}
+	if !rng.From.Before(rng.To) {
+		return rng, fmt.Errorf("from must not be after to")
+	}
+	n := 0
+	for t := g.truncate(rng.From); t.Before(rng.To); t = g.next(t) {
+		if n++; n > maxIngestionPoints {
+			return rng, fmt.Errorf("date range too large for %s granularity (max %d points)", rng.Granularity, maxIngestionPoints)
+		}
+	}
+
+	if s := q.Get("threshold"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 {
+			return rng, fmt.Errorf("invalid threshold %q", s)
+		}
+		rng.Threshold = v
+	}
+	return rng, nil
+}
+
+// ingestionFromRequest 按user或bucket参数统计新增文件
+func ingestionFromRequest(r *http.Request, dbID string) (*IngestionReport, int, error) {
+	q := r.URL.Query()
+	rng, err := ingestionRangeFromRequest(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// 先校验参数，再获取连接
+	var query func(db *DB) (*IngestionReport, error)
+	switch {
+	case q.Get("bucket") != "":
+		bid, err := strconv.ParseUint(q.Get("bucket"), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid bucket ID")
+		}
+		query = func(db *DB) (*IngestionReport, error) { return getBucketIngestion(db, bid, rng) }
+	case q.Get("user") != "":
+		uid, err := strconv.ParseUint(q.Get("user"), 10, 64)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid user ID")
+		}
+		query = func(db *DB) (*IngestionReport, error) { return getUserIngestion(db, uid, rng) }
+	default:
+		return nil, http.StatusBadRequest, fmt.Errorf("one of user or bucket is required")
+	}
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	report, err := query(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	report.Route = &route
+	return report, http.StatusOK, nil
+}
+
+// ingestionHandler 按小时、天或月显示新增文件的柱状图，突增的时间段高亮
+func ingestionHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling ingestion request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	granularity := q.Get("granularity")
+	if granularity == "" {
+		granularity = "day"
+	}
+	data := map[string]interface{}{
+		"Configs":     cfg.Configs,
+		"SelectedDB":  dbID,
+		"User":        q.Get("user"),
+		"Bucket":      q.Get("bucket"),
+		"Granularity": granularity,
+		"From":        q.Get("from"),
+		"To":          q.Get("to"),
+		"Threshold":   q.Get("threshold"),
+	}
+	if q.Get("user") != "" || q.Get("bucket") != "" {
+		report, cache, status, err := cachedQuery(r, dbID, "ingestion", []string{"user", "bucket", "from", "to", "granularity", "threshold"}, func() (*IngestionReport, int, error) {
+			return ingestionFromRequest(r, dbID)
+		})
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		data["Report"] = report
+		data["Cache"] = cache
+		data["ElapsedTime"] = time.Since(startTime).String()
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/ingestion.html", "templates/read_route.html", "templates/cache_info.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "ingestionHandler completed", "elapsed", time.Since(startTime))
+}
+
+// ingestionAPIHandler 以JSON返回新增文件统计
+func ingestionAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	report, cache, status, err := cachedQuery(r, dbID, "ingestion", []string{"user", "bucket", "from", "to", "granularity", "threshold"}, func() (*IngestionReport, int, error) {
+		return ingestionFromRequest(r, dbID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cache.SetHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
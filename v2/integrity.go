@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 每类问题默认保留的样例数
+const defaultIntegritySamples = 10
+
+// 每类问题最多返回的样例数，样例查询在每个分区表上都会执行
+const maxIntegritySamples = 100
+
+// 检查出的问题类型
+const (
+	IssueOrphanFile        = "orphan_file"         // 文件的bid在buckets中不存在
+	IssueMisplacedFile     = "misplaced_file"      // 文件所在分区表与bucket的part不一致
+	IssueBucketMissingUser = "bucket_missing_user" // bucket的user在users中不存在
+	IssueInvalidBucketPart = "invalid_bucket_part" // bucket的part不是00~ff
+)
+
+// IntegritySample 问题记录样例
+type IntegritySample struct {
+	FID        uint64 `json:"fid,omitempty"`
+	FName      string `json:"fname,omitempty"`
+	BID        uint64 `json:"bid"`
+	BName      string `json:"bname,omitempty"`
+	BucketPart string `json:"bucket_part,omitempty"`
+	UserID     uint64 `json:"user_id,omitempty"`
+}
+
+// IntegrityIssue 某个分区(或buckets表)中的一类问题
+type IntegrityIssue struct {
+	Kind    string            `json:"kind"`
+	Part    string            `json:"part,omitempty"`
+	Count   uint64            `json:"count"`
+	Samples []IntegritySample `json:"samples"`
+}
+
+// IntegrityReport 一次完整检查的结果
+type IntegrityReport struct {
+	DB                 string           `json:"db"`
+	StartedAt          time.Time        `json:"started_at"`
+	Elapsed            string           `json:"elapsed"`
+	OrphanFiles        uint64           `json:"orphan_files"`
+	MisplacedFiles     uint64           `json:"misplaced_files"`
+	BucketsMissingUser uint64           `json:"buckets_missing_user"`
+	InvalidBucketParts uint64           `json:"invalid_bucket_parts"`
+	Issues             []IntegrityIssue `json:"issues"`
+	// 查询失败的分区，例如分区表不存在
+	Errors []string   `json:"errors,omitempty"`
+	Route  *ReadRoute `json:"read_route,omitempty"`
+}
+
+// IssueCount 问题总数
+func (r *IntegrityReport) IssueCount() uint64 {
+	return r.OrphanFiles + r.MisplacedFiles + r.BucketsMissingUser + r.InvalidBucketParts
+}
+
+// checkIntegrity 扫描buckets表和全部256个分区表，检查孤儿文件、分区错位和缺失用户
+func checkIntegrity(db *DB, sampleLimit int) (*IntegrityReport, error) {
+	if sampleLimit <= 0 {
+		sampleLimit = defaultIntegritySamples
+	}
+	report := &IntegrityReport{StartedAt: time.Now()}
+
+	// buckets表自身的问题
+	missingUser, err := checkBucketsMissingUser(db, sampleLimit)
+	if err != nil {
+		return nil, err
+	}
+	invalidPart, err := checkInvalidBucketParts(db, sampleLimit)
+	if err != nil {
+		return nil, err
+	}
+	for _, issue := range []*IntegrityIssue{missingUser, invalidPart} {
+		if issue.Count > 0 {
+			report.Issues = append(report.Issues, *issue)
+		}
+	}
+	report.BucketsMissingUser = missingUser.Count
+	report.InvalidBucketParts = invalidPart.Count
+
+	// 并发扫描分区表
+	var mu sync.Mutex
+	forEachPartition(func(part string) {
+		issues, err := checkPartitionIntegrity(db, part, sampleLimit)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			slog.WarnContext(db.ctx, "Integrity check for partition failed", "part", part, "err", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("partition %s: %v", part, err))
+		}
+		for _, issue := range issues {
+			switch issue.Kind {
+			case IssueOrphanFile:
+				report.OrphanFiles += issue.Count
+			case IssueMisplacedFile:
+				report.MisplacedFiles += issue.Count
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	})
+
+	sort.Slice(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Kind != report.Issues[j].Kind {
+			return report.Issues[i].Kind < report.Issues[j].Kind
+		}
+		return report.Issues[i].Part < report.Issues[j].Part
+	})
+	sort.Strings(report.Errors)
+	report.Elapsed = time.Since(report.StartedAt).String()
+	return report, nil
+}
+
+// checkPartitionIntegrity 检查单个分区表中的孤儿文件和错位文件
+func checkPartitionIntegrity(db *DB, part string, sampleLimit int) ([]IntegrityIssue, error) {
+	var issues []IntegrityIssue
+
+	// 孤儿文件：bid在buckets表中不存在
+	orphan := IntegrityIssue{Kind: IssueOrphanFile, Part: part}
+	query := fmt.Sprintf("SELECT COUNT(*) FROM bucket_files_%s f LEFT JOIN buckets b ON f.bid = b.bid WHERE b.bid IS NULL", part)
+	if err := db.QueryRow(query).Scan(&orphan.Count); err != nil {
+		return nil, err
+	}
+	if orphan.Count > 0 {
+		query = fmt.Sprintf("SELECT f.fid, f.fname, f.bid FROM bucket_files_%s f LEFT JOIN buckets b ON f.bid = b.bid "+
+			"WHERE b.bid IS NULL ORDER BY f.fid LIMIT ?", part)
+		rows, err := db.Query(query, sampleLimit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s IntegritySample
+			if err := rows.Scan(&s.FID, &s.FName, &s.BID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			orphan.Samples = append(orphan.Samples, s)
+		}
+		rows.Close()
+		issues = append(issues, orphan)
+	}
+
+	// 错位文件：bucket记录的part与文件所在分区表不一致
+	misplaced := IntegrityIssue{Kind: IssueMisplacedFile, Part: part}
+	query = fmt.Sprintf("SELECT COUNT(*) FROM bucket_files_%s f JOIN buckets b ON f.bid = b.bid WHERE b.part <> ?", part)
+	if err := db.QueryRow(query, part).Scan(&misplaced.Count); err != nil {
+		return issues, err
+	}
+	if misplaced.Count > 0 {
+		query = fmt.Sprintf("SELECT f.fid, f.fname, f.bid, b.bname, b.part, b.user FROM bucket_files_%s f JOIN buckets b ON f.bid = b.bid "+
+			"WHERE b.part <> ? ORDER BY f.fid LIMIT ?", part)
+		rows, err := db.Query(query, part, sampleLimit)
+		if err != nil {
+			return issues, err
+		}
+		for rows.Next() {
+			var s IntegritySample
+			if err := rows.Scan(&s.FID, &s.FName, &s.BID, &s.BName, &s.BucketPart, &s.UserID); err != nil {
+				rows.Close()
+				return issues, err
+			}
+			misplaced.Samples = append(misplaced.Samples, s)
+		}
+		rows.Close()
+		issues = append(issues, misplaced)
+	}
+	return issues, nil
+}
+
+// checkBucketsMissingUser bucket的user在users表中不存在
+func checkBucketsMissingUser(db *DB, sampleLimit int) (*IntegrityIssue, error) {
+	issue := &IntegrityIssue{Kind: IssueBucketMissingUser}
+	const cond = " FROM buckets b LEFT JOIN users u ON b.user = u.id WHERE u.id IS NULL"
+	if err := db.QueryRow("SELECT COUNT(*)" + cond).Scan(&issue.Count); err != nil {
+		return nil, err
+	}
+	if issue.Count == 0 {
+		return issue, nil
+	}
+	return issue, scanBucketSamples(db, "SELECT b.bid, b.bname, b.part, b.user"+cond+" ORDER BY b.bid LIMIT ?", sampleLimit, issue)
+}
+
+// checkInvalidBucketParts bucket的part不是小写的两位十六进制，无法对应到分区表
+func checkInvalidBucketParts(db *DB, sampleLimit int) (*IntegrityIssue, error) {
+	issue := &IntegrityIssue{Kind: IssueInvalidBucketPart}
+	const cond = " FROM buckets b WHERE BINARY b.part NOT REGEXP '^[0-9a-f]{2}$'"
+	if err := db.QueryRow("SELECT COUNT(*)" + cond).Scan(&issue.Count); err != nil {
+		return nil, err
+	}
+	if issue.Count == 0 {
+		return issue, nil
+	}
+	return issue, scanBucketSamples(db, "SELECT b.bid, b.bname, b.part, b.user"+cond+" ORDER BY b.bid LIMIT ?", sampleLimit, issue)
+}
+
+func scanBucketSamples(db *DB, query string, sampleLimit int, issue *IntegrityIssue) error {
+	rows, err := db.Query(query, sampleLimit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s IntegritySample
+		if err := rows.Scan(&s.BID, &s.BName, &s.BucketPart, &s.UserID); err != nil {
+			return err
+		}
+		issue.Samples = append(issue.Samples, s)
+	}
+	return rows.Err()
+}
+
+// integrityHandler 数据检查页面，点击检查后才执行扫描
+func integrityHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling integrity request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Configs":    cfg.Configs,
+		"SelectedDB": dbID,
+		"Samples":    r.URL.Query().Get("samples"),
+	}
+	if r.URL.Query().Get("run") == "1" {
+		report, status, err := runIntegrityCheck(r.Context(), dbID, r.URL.Query().Get("samples"))
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		data["Report"] = report
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/integrity.html", "templates/read_route.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "integrityHandler completed", "elapsed", time.Since(startTime))
+}
+
+// integrityAPIHandler 以JSON返回检查结果
+func integrityAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	report, status, err := runIntegrityCheck(r.Context(), dbID, r.URL.Query().Get("samples"))
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// runIntegrityCheck 获取连接并执行检查，出错时返回对应的HTTP状态码
+func runIntegrityCheck(ctx context.Context, dbID, samplesStr string) (*IntegrityReport, int, error) {
+	samples := defaultIntegritySamples
+	if samplesStr != "" {
+		n, err := strconv.Atoi(samplesStr)
+		if err != nil || n <= 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid samples %q", samplesStr)
+		}
+		samples = min(n, maxIntegritySamples)
+	}
+
+	db, release, route, err := getReadDB(ctx, dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	report, err := checkIntegrity(db, samples)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("integrity check failed: %w", err)
+	}
+	report.DB = dbID
+	report.Route = &route
+	return report, http.StatusOK, nil
+}
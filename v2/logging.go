@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// logLevel 当前的日志级别，可通过配置log_level或/debug/log-level在运行时修改
+var logLevel = new(slog.LevelVar)
+
+// setupLogging 使用slog输出日志，format为json或text。
+// 标准库log的输出也会转到slog
+func setupLogging(w io.Writer, format string) error {
+	opts := &slog.HandlerOptions{AddSource: true, Level: logLevel}
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, expected json or text", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// parseLogLevel 解析debug、info、warn、error
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+// contextHandler 把context中的请求ID加到每条日志
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// fatal 记录错误并退出，日志的source为调用fatal的位置
+func fatal(msg string, args ...interface{}) {
+	var pcs [1]uintptr
+	runtime.Callers(2, pcs[:]) // 跳过runtime.Callers和fatal
+	r := slog.NewRecord(time.Now(), slog.LevelError, msg, pcs[0])
+	r.Add(args...)
+	slog.Default().Handler().Handle(context.Background(), r)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// 客户端传入的X-Request-ID只接受这些字符，避免日志注入
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID 返回context中的请求ID，后台任务没有请求ID
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder 记录响应的状态码
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush 导出等流式响应需要
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// requestIDMiddleware 为每个请求分配ID(沿用客户端传入的X-Request-ID)，写入响应头并在请求结束时记录访问日志
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := withRequestID(r.Context(), id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		slog.InfoContext(ctx, "Request completed",
+			"method", r.Method, "path", r.URL.Path, "status", rec.status,
+			"clientip", r.RemoteAddr, "elapsed", time.Since(start))
+	})
+}
+
+// logLevelHandler GET返回当前日志级别，管理员POST level=<级别>修改，配置文件中的log_level变化时会覆盖
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		if !isAdmin(r) {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		level, err := parseLogLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		slog.WarnContext(r.Context(), "Log level changed", "level", level.String(), "clientip", r.RemoteAddr)
+		if r.Header.Get("Accept") != "application/json" {
+			http.Redirect(w, r, "/debug/queries", http.StatusSeeOther)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": strings.ToLower(logLevel.Level().String())})
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
-	"database/sql"
+	"crypto/tls"
 	"embed"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,44 +20,153 @@ var templates embed.FS
 
 var (
 	appConfig     AppConfig
-	dbConnections = make(map[int]*sql.DB) // 存储数据库连接池
+	dbManager     = NewDBManager() // 管理数据库连接池
+	healthMonitor *HealthMonitor
 )
 
 func main() {
-	// 日志打印行号
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	// 支持自定义监听端口
-	port := flag.String("port", "8888", "server listen port")
+	// 子命令的日志使用文本格式，服务启动后按-log-format设置
+	setupLogging(os.Stderr, "text")
+
+	// 第一个参数不是flag时作为子命令执行，例如: simple_web_tool integrity -db testdb
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	// 支持自定义监听端口，-addr 可指定完整的监听地址，优先于 -port
+	port := flag.String("port", "8888", "server listen port, ignored when -addr is set")
+	addr := flag.String("addr", "", "server listen address, e.g. 127.0.0.1:8443")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enables HTTPS together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	redirectAddr := flag.String("http-redirect-addr", "", "listen address of an HTTP server redirecting to HTTPS, e.g. :80")
+	flag.StringVar(&configPath, "config", configPath, "config file path")
+	flag.StringVar(&snapshotDir, "snapshot-dir", snapshotDir, "directory to store database snapshots for comparison")
+	watchInterval := flag.Duration("config-watch-interval", 5*time.Second, "interval to check config file for changes, 0 to disable hot reload")
+	healthInterval := flag.Duration("health-interval", 30*time.Second, "interval to check health of all configured databases, must be positive")
+	readTimeout := flag.Duration("read-timeout", 30*time.Second, "maximum duration for reading the entire request")
+	// 全量统计会查询所有分区表，写超时需要留足时间
+	writeTimeout := flag.Duration("write-timeout", 5*time.Minute, "maximum duration before timing out writes of the response")
+	idleTimeout := flag.Duration("idle-timeout", 2*time.Minute, "maximum time to wait for the next request on keep-alive connections")
+	shutdownTimeout := flag.Duration("shutdown-timeout", time.Minute, "maximum time to wait for in-flight requests on shutdown")
+	logFormat := flag.String("log-format", "json", "log output format, json or text")
 	flag.Parse()
 
+	if err := setupLogging(os.Stderr, *logFormat); err != nil {
+		fatal(err.Error())
+	}
+	// 从库路由依赖健康检查，不能关闭
+	if *healthInterval <= 0 {
+		fatal("health-interval must be positive", "value", healthInterval.String())
+	}
+
 	err := loadConfig()
 	if err != nil {
-		log.Fatal(err)
+		fatal(err.Error())
 	}
 
-	// 初始化默认数据库连接
-	if appConfig.DefaultDBIndex != -1 && appConfig.DefaultDBIndex < len(appConfig.Configs) {
-		cfg := appConfig.Configs[appConfig.DefaultDBIndex]
-		db, err := connectDB(cfg)
-		if err != nil {
-			log.Fatalf("Failed to connect to default database %d: %v", appConfig.DefaultDBIndex, err)
-		}
-		dbConnections[appConfig.DefaultDBIndex] = db
+	// 数据库连接在首次使用时建立
+	if err := applyConfig(appConfig); err != nil {
+		fatal(err.Error())
 	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// stop关闭时通知后台任务退出
+	stop := make(chan struct{})
+	go dbManager.RunIdleReaper(stop)
+
+	// 定期检查所有数据库的状态
+	healthMonitor = NewHealthMonitor(*healthInterval)
+	go healthMonitor.Run(stop)
+	go reportScheduler.Run(stop)
+
+	// 监听配置文件变化
+	if *watchInterval > 0 {
+		go watchConfig(configPath, *watchInterval, stop)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/config", http.StatusFound)
 	}) // 根路由重定向到 /user-stats
-	http.HandleFunc("/config", configHandler)
-	http.HandleFunc("/user-stats", userStatsHandler)
-	http.HandleFunc("/files", filesHandler)
+	mux.HandleFunc("/config", configHandler)
+	mux.HandleFunc("/user-stats", userStatsHandler)
+	mux.HandleFunc("/api/user-stats", userStatsAPIHandler)
+	mux.HandleFunc("/files", filesHandler)
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/api/health", healthAPIHandler)
+	mux.HandleFunc("/cache", cacheHandler)
+	mux.HandleFunc("/debug/queries", debugQueriesHandler)
+	mux.HandleFunc("/debug/log-level", logLevelHandler)
+	mux.HandleFunc("/integrity", integrityHandler)
+	mux.HandleFunc("/api/integrity", integrityAPIHandler)
+	mux.HandleFunc("/histogram", histogramHandler)
+	mux.HandleFunc("/api/histogram", histogramAPIHandler)
+	mux.HandleFunc("/partitions", partitionsHandler)
+	mux.HandleFunc("/api/partitions", partitionsAPIHandler)
+	mux.HandleFunc("/export", exportHandler)
+	mux.HandleFunc("/compare", compareHandler)
+	mux.HandleFunc("/api/compare", compareAPIHandler)
+	mux.HandleFunc("/reports", reportsHandler)
+	mux.HandleFunc("/api/reports", reportsAPIHandler)
+	mux.HandleFunc("/ingestion", ingestionHandler)
+	mux.HandleFunc("/api/ingestion", ingestionAPIHandler)
+	mux.HandleFunc("/forecast", forecastHandler)
+	mux.HandleFunc("/api/forecast", forecastAPIHandler)
+	mux.HandleFunc("/partitions/plan", planHandler)
+	mux.HandleFunc("/api/partitions/plan", planAPIHandler)
+	mux.HandleFunc("/extensions", extensionsHandler)
+	mux.HandleFunc("/api/extensions", extensionsAPIHandler)
+	mux.HandleFunc("/duplicates", duplicatesHandler)
+	mux.HandleFunc("/api/duplicates", duplicatesAPIHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+
+	listenAddr := *addr
+	if listenAddr == "" {
+		listenAddr = fmt.Sprintf(":%s", *port)
+	}
+	srv := &http.Server{
+		Addr:              listenAddr,
+		Handler:           requestIDMiddleware(queryOriginMiddleware(mux)),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+
+	// 配置了证书时使用HTTPS，证书文件更新后自动加载
+	var redirect *http.Server
+	if *tlsCert != "" || *tlsKey != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			fatal("both -tls-cert and -tls-key are required to enable TLS")
+		}
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			fatal(err.Error())
+		}
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+		if *redirectAddr != "" {
+			redirect = newRedirectServer(*redirectAddr, listenAddr)
+			slog.Info("Redirecting HTTP to HTTPS", "addr", *redirectAddr)
+		}
+	} else if *redirectAddr != "" {
+		fatal("-http-redirect-addr requires TLS to be enabled")
+	}
 
-	log.Printf("Starting server on port %s", *port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", *port), nil))
+	if srv.TLSConfig != nil {
+		slog.Info("Starting HTTPS server", "addr", listenAddr)
+	} else {
+		slog.Info("Starting server", "addr", listenAddr)
+	}
+	if err := runServer(srv, redirect, *shutdownTimeout, stop); err != nil {
+		fatal(err.Error())
+	}
 }
 
 func configHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling config request, clientip:", r.RemoteAddr, " method:", r.Method)
+	slog.DebugContext(r.Context(), "Handling config request", "clientip", r.RemoteAddr, "method", r.Method)
 	startTime := time.Now()
 	switch r.Method {
 	case http.MethodGet:
@@ -65,111 +176,87 @@ func configHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		cfg := getAppConfig()
 		if err := tmpl.Execute(w, map[string]interface{}{
-			"Configs":        appConfig.Configs,
-			"DefaultDBIndex": appConfig.DefaultDBIndex,
+			"Configs":   cfg.Configs,
+			"DefaultDB": cfg.DefaultDB,
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
 	case http.MethodPost:
-		var req AppConfig
-		err := json.NewDecoder(r.Body).Decode(&req)
+		var form AppConfig
+		err := json.NewDecoder(r.Body).Decode(&form)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		// 页面只编辑数据库列表和默认库，其他设置(报表、分类等)保留当前值
+		req := getAppConfig()
+		// 页面不编辑从库，按ID保留当前配置的从库
+		for i, c := range form.Configs {
+			if c.Replicas != nil {
+				continue
+			}
+			if cur, ok := req.findConfig(c.ID); ok {
+				form.Configs[i].Replicas = cur.Replicas
+			}
+		}
+		req.Configs = form.Configs
+		req.DefaultDB = form.DefaultDB
+		req.DefaultDBIndex = nil
+
+		// 验证默认库是否存在
+		defaultCfg, ok := req.findConfig(req.DefaultDB)
+		if !ok {
+			http.Error(w, "Default database not found in configs.", http.StatusBadRequest)
+			return
+		}
 
-		// 验证DefaultDBIndex是否在有效范围内
-		if req.DefaultDBIndex < 0 || req.DefaultDBIndex >= len(req.Configs) {
-			http.Error(w, "DefaultDBIndex out of bounds.", http.StatusBadRequest)
+		if err := validateConfig(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// 测试默认数据库连接
-		if req.DefaultDBIndex >= 0 && req.DefaultDBIndex < len(req.Configs) {
-			if err := testDBConnection(req.Configs[req.DefaultDBIndex]); err != nil {
-				http.Error(w, "无法连接到默认数据库: "+err.Error(), http.StatusBadRequest)
-				return
-			}
+		if err := testDBConnection(defaultCfg); err != nil {
+			http.Error(w, "无法连接到默认数据库: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		appConfig.Configs = req.Configs
-		appConfig.DefaultDBIndex = req.DefaultDBIndex
-
-		if err := saveConfig(); err != nil {
+		if err := saveConfig(req); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// 关闭所有旧的数据库连接
-		for _, db := range dbConnections {
-			if db != nil {
-				db.Close()
-			}
-		}
-		// 清空连接池
-		dbConnections = make(map[int]*sql.DB)
-
-		// 重新初始化默认数据库连接
-		if appConfig.DefaultDBIndex != -1 && appConfig.DefaultDBIndex < len(appConfig.Configs) {
-			cfg := appConfig.Configs[appConfig.DefaultDBIndex]
-			db, err := connectDB(cfg)
-			if err != nil {
-				log.Printf("Failed to connect to default database %d after config update: %v", appConfig.DefaultDBIndex, err)
-				// 即使连接失败，也尝试保存已有的连接，避免程序崩溃
-				dbConnections[appConfig.DefaultDBIndex] = nil // 标记为无效连接
-			} else {
-				dbConnections[appConfig.DefaultDBIndex] = db
-			}
+		// 替换配置并重新初始化默认数据库连接，旧连接池延迟关闭
+		if err := applyConfig(req); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to apply config update", "err", err)
 		}
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	log.Printf("configHandler completed in %v", time.Since(startTime))
+	slog.DebugContext(r.Context(), "configHandler completed", "elapsed", time.Since(startTime))
 }
 
 func userStatsHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
-	log.Println("Handling user stats request, clientip:", r.RemoteAddr, " method:", r.Method)
-
-	dbIndexStr := r.URL.Query().Get("db")
-	var selectedIndex int = -1 // Use an int to track the actual index
-
-	// Determine the effective database index
-	if dbIndexStr == "" {
-		// If no db parameter, use the default config
-		if appConfig.DefaultDBIndex != -1 && appConfig.DefaultDBIndex < len(appConfig.Configs) {
-			selectedIndex = appConfig.DefaultDBIndex
-			dbIndexStr = strconv.Itoa(selectedIndex)
-		} else if len(appConfig.Configs) > 0 {
-			// If no valid default found, use the first config if available
-			selectedIndex = 0
-			dbIndexStr = "0"
-		}
-	} else {
-		idx, err := strconv.Atoi(dbIndexStr)
-		if err != nil || idx < 0 || idx >= len(appConfig.Configs) {
-			http.Error(w, "Invalid database index", http.StatusBadRequest)
-			return
-		}
-		selectedIndex = idx
-	}
+	slog.DebugContext(r.Context(), "Handling user stats request", "clientip", r.RemoteAddr, "method", r.Method)
 
-	// If a valid configuration is selected (or defaulted to)
-	if selectedIndex == -1 {
-		http.Error(w, "No database selected or configured.", http.StatusBadRequest)
+	cfg := getAppConfig()
+	if r.URL.Query().Get("db") == allDatabases {
+		allUserStatsHandler(w, r, cfg, startTime)
 		return
 	}
-
-	db, ok := dbConnections[selectedIndex]
-	if !ok || db == nil {
-		http.Error(w, "Database connection not found or invalid.", http.StatusInternalServerError)
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
 		return
 	}
 
+	refresh := r.URL.Query().Get("refresh") == "1"
+
 	typeParam := r.URL.Query().Get("type")
-	log.Printf("typeParam: %s", typeParam)
+	slog.DebugContext(r.Context(), "User stats request", "type", typeParam)
 	if typeParam == "bucket" {
 		bidFilter := r.URL.Query().Get("bid")
 		bnameFilter := r.URL.Query().Get("bname")
@@ -184,37 +271,51 @@ func userStatsHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		bucketStats, err := getUserStats(db, bidFilter, bnameFilter, usernameFilter, limit)
+		filter := userStatsFilter{BID: bidFilter, BName: bnameFilter, Username: usernameFilter, Limit: limit}
+		bucketStats, route, cache, err := cachedUserStats(r.Context(), dbID, filter, refresh)
 		if err != nil {
 			http.Error(w, "Error getting bucket stats: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		cache.RefreshURL = refreshURL(r)
 
 		data := struct {
-			Users           []UserStats
-			Configs         []Config
-			SelectedDBIndex string
-			ElapsedTime     string
+			Users       []UserStats
+			Configs     []Config
+			SelectedDB  string
+			BID         string
+			BName       string
+			Username    string
+			Limit       int
+			Route       *ReadRoute
+			Cache       *CacheInfo
+			ElapsedTime string
 		}{
-			Users:           bucketStats,
-			Configs:         appConfig.Configs,
-			SelectedDBIndex: dbIndexStr,
-			ElapsedTime:     time.Since(startTime).String(),
+			Users:       bucketStats,
+			Configs:     cfg.Configs,
+			SelectedDB:  dbID,
+			BID:         bidFilter,
+			BName:       bnameFilter,
+			Username:    usernameFilter,
+			Limit:       limit,
+			Route:       &route,
+			Cache:       &cache,
+			ElapsedTime: time.Since(startTime).String(),
 		}
 
 		if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
-			tmpl, err := template.ParseFS(templates, "templates/bucket_stats_content.html")
+			tmpl, err := template.ParseFS(templates, "templates/bucket_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			tmpl.Execute(w, data)
 
-			log.Printf("userStatsHandler completed in %v", time.Since(startTime))
+			slog.DebugContext(r.Context(), "userStatsHandler completed", "elapsed", time.Since(startTime))
 			return
 		}
 
-		tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/user_stats.html", "templates/bucket_stats_content.html")
+		tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/user_stats.html", "templates/bucket_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -227,11 +328,12 @@ func userStatsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// Default behavior for general user stats
-		userStats, err := getUserStats(db, "", "", "", 0) // Pass empty filters for general user stats
+		userStats, route, cache, err := cachedUserStats(r.Context(), dbID, userStatsFilter{}, refresh) // Pass empty filters for general user stats
 		if err != nil {
 			http.Error(w, "Error getting user stats: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		cache.RefreshURL = refreshURL(r)
 
 		// 总体统计，用户数、文件数、总大小
 		type TotalStats struct {
@@ -247,32 +349,36 @@ func userStatsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		data := struct {
-			TotalStats      TotalStats
-			Users           []UserStats
-			Configs         []Config
-			SelectedDBIndex string
-			ElapsedTime     string
+			TotalStats  TotalStats
+			Users       []UserStats
+			Configs     []Config
+			SelectedDB  string
+			Route       *ReadRoute
+			Cache       *CacheInfo
+			ElapsedTime string
 		}{
-			TotalStats:      totalStats,
-			Users:           userStats,
-			Configs:         appConfig.Configs,
-			SelectedDBIndex: dbIndexStr,
-			ElapsedTime:     time.Since(startTime).String(),
+			TotalStats:  totalStats,
+			Users:       userStats,
+			Configs:     cfg.Configs,
+			SelectedDB:  dbID,
+			Route:       &route,
+			Cache:       &cache,
+			ElapsedTime: time.Since(startTime).String(),
 		}
 
 		// AJAX 请求，只返回内容部分
 		if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
-			tmpl, err := template.ParseFS(templates, "templates/user_stats_content.html")
+			tmpl, err := template.ParseFS(templates, "templates/user_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			tmpl.Execute(w, data)
-			log.Printf("userStatsHandler AJAX completed in %v", time.Since(startTime))
+			slog.DebugContext(r.Context(), "userStatsHandler AJAX completed", "elapsed", time.Since(startTime))
 			return
 		}
 
-		tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/user_stats.html", "templates/user_stats_content.html")
+		tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/user_stats.html", "templates/user_stats_content.html", "templates/read_route.html", "templates/cache_info.html")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -284,24 +390,57 @@ func userStatsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	log.Printf("userStatsHandler completed in %v", time.Since(startTime))
+	slog.DebugContext(r.Context(), "userStatsHandler completed", "elapsed", time.Since(startTime))
+}
+
+// selectDBConfig 根据?db=参数确定数据库ID，未指定时使用默认库。
+// 兼容旧的按下标访问的URL(?db=1)，重定向到对应ID的URL。返回false时已写入响应
+func selectDBConfig(w http.ResponseWriter, r *http.Request, cfg AppConfig) (string, bool) {
+	dbID := r.URL.Query().Get("db")
+	if dbID == "" {
+		if cfg.DefaultDB == "" {
+			http.Error(w, "No database selected or configured.", http.StatusBadRequest)
+			return "", false
+		}
+		return cfg.DefaultDB, true
+	}
+	if _, ok := cfg.findConfig(dbID); ok {
+		return dbID, true
+	}
+
+	// 旧版本URL使用配置下标
+	if idx, err := strconv.Atoi(dbID); err == nil && idx >= 0 && idx < len(cfg.Configs) {
+		q := r.URL.Query()
+		q.Set("db", cfg.Configs[idx].ID)
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return "", false
+	}
+	http.Error(w, "Unknown database: "+dbID, http.StatusBadRequest)
+	return "", false
 }
 
 func filesHandler(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
-	log.Println("Handling files request, clientip:", r.RemoteAddr, " method:", r.Method)
+	slog.DebugContext(r.Context(), "Handling files request", "clientip", r.RemoteAddr, "method", r.Method)
 
 	userIDStr := r.URL.Query().Get("user")
 	part := r.URL.Query().Get("part")
 	fidStr := r.URL.Query().Get("fid")
 	fname := r.URL.Query().Get("fname")
 	bucketIDStr := r.URL.Query().Get("bucket")
-	log.Printf("req userID: %s, part: %s, fidStr: %s, fname: %s, bucketID: %s\n", userIDStr, part, fidStr, fname, bucketIDStr)
+	slog.DebugContext(r.Context(), "Files request", "user", userIDStr, "part", part, "fid", fidStr, "fname", fname, "bucket", bucketIDStr)
 
 	if userIDStr == "" || part == "" {
 		http.Error(w, "Missing required parameters", http.StatusBadRequest)
 		return
 	}
+	// 分区号会拼接到表名中
+	if !isValidPartition(part) {
+		http.Error(w, "Invalid partition", http.StatusBadRequest)
+		return
+	}
 
 	// Parse parameters
 	uid, err := strconv.ParseUint(userIDStr, 10, 64)
@@ -328,34 +467,18 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	dbIndexStr := r.URL.Query().Get("db")
-	var selectedIndex int = -1
-
-	if dbIndexStr == "" {
-		if appConfig.DefaultDBIndex != -1 && appConfig.DefaultDBIndex < len(appConfig.Configs) {
-			selectedIndex = appConfig.DefaultDBIndex
-		} else if len(appConfig.Configs) > 0 {
-			selectedIndex = 0
-		}
-	} else {
-		idx, err := strconv.Atoi(dbIndexStr)
-		if err != nil || idx < 0 || idx >= len(appConfig.Configs) {
-			http.Error(w, "Invalid database index", http.StatusBadRequest)
-			return
-		}
-		selectedIndex = idx
-	}
-
-	if selectedIndex == -1 {
-		http.Error(w, "No database configured or selected", http.StatusInternalServerError)
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
 		return
 	}
 
-	db, ok := dbConnections[selectedIndex]
-	if !ok || db == nil {
-		http.Error(w, "Database connection not found or invalid.", http.StatusInternalServerError)
+	db, release, err := dbManager.Get(r.Context(), dbID)
+	if err != nil {
+		http.Error(w, "Database connection not available: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer release()
 
 	// Query files
 	files, err := getFiles(db, uid, part, fid, fname, bucketID) // Modified: added bucketID
@@ -385,26 +508,28 @@ func filesHandler(w http.ResponseWriter, r *http.Request) {
 			"FID":         fidStr,
 			"FName":       fname,
 			"BucketID":    bucketID,
+			"DB":          dbID,
 			"ElapsedTime": elapsedTime,
 		}); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
-		log.Printf("specific filesHandler AJAX completed in %v", elapsedTime)
+		slog.DebugContext(r.Context(), "filesHandler AJAX completed", "elapsed", elapsedTime)
 		return
 	}
 
 	elapsedTime := time.Since(startTime).String()
 	if err := tmpl.Execute(w, map[string]interface{}{
 		"Files":       files,
-		"Configs":     appConfig.Configs,
+		"Configs":     cfg.Configs,
 		"UserID":      uid,
 		"Part":        part,
 		"FID":         fidStr,
 		"FName":       fname,
 		"BucketID":    bucketID,
+		"DB":          dbID,
 		"ElapsedTime": elapsedTime,
 	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	log.Printf("filesHandler completed in %v", elapsedTime)
+	slog.DebugContext(r.Context(), "filesHandler completed", "elapsed", elapsedTime)
 }
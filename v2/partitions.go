@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 默认分析的热点分区数量
+	defaultHotPartitions = 5
+	// 每个热点分区列出的bucket数量
+	hotPartitionContributors = 10
+)
+
+// PartitionLoad 单个分区表的数据量
+type PartitionLoad struct {
+	Part    string `json:"part"`
+	Rows    uint64 `json:"rows"`
+	Bytes   uint64 `json:"bytes"`
+	Buckets uint64 `json:"buckets"` // buckets表中part为该分区的bucket数
+	// 相对于最大分区的比例(0~1)，用于热力图着色
+	RowHeat    float64 `json:"-"`
+	ByteHeat   float64 `json:"-"`
+	BucketHeat float64 `json:"-"`
+}
+
+// SkewStats 分区之间的分布是否均匀，MaxOverMean越接近1、Gini越接近0越均匀
+type SkewStats struct {
+	Mean        float64 `json:"mean"`
+	Min         float64 `json:"min"`
+	Max         float64 `json:"max"`
+	StdDev      float64 `json:"stddev"`
+	MaxOverMean float64 `json:"max_over_mean"`
+	Gini        float64 `json:"gini"`
+}
+
+// PartitionContributor 热点分区中占用最多的bucket
+type PartitionContributor struct {
+	BID    uint64  `json:"bid"`
+	BName  string  `json:"bname"`
+	UserID uint64  `json:"user_id"`
+	Rows   uint64  `json:"rows"`
+	Bytes  uint64  `json:"bytes"`
+	Share  float64 `json:"share"` // 占分区大小的百分比
+}
+
+// HotPartition 按大小排序的热点分区及其主要来源
+type HotPartition struct {
+	PartitionLoad
+	Contributors []PartitionContributor `json:"contributors"`
+}
+
+// PartitionReport 分区均衡分析结果
+type PartitionReport struct {
+	DB           string            `json:"db"`
+	TotalRows    uint64            `json:"total_rows"`
+	TotalBytes   uint64            `json:"total_bytes"`
+	TotalBuckets uint64            `json:"total_buckets"`
+	RowSkew      SkewStats         `json:"row_skew"`
+	ByteSkew     SkewStats         `json:"byte_skew"`
+	BucketSkew   SkewStats         `json:"bucket_skew"`
+	Partitions   []PartitionLoad   `json:"partitions"`
+	Grid         [][]PartitionLoad `json:"-"` // 16x16，行为高4位，列为低4位
+	Hot          []HotPartition    `json:"hot"`
+	// 容量预测，最先达到目标的排在前面
+	CapacityTarget uint64              `json:"capacity_target"`
+	Forecasts      []PartitionForecast `json:"forecasts"`
+	Errors         []string            `json:"errors,omitempty"`
+	Elapsed        string              `json:"elapsed"`
+	Route          *ReadRoute          `json:"read_route,omitempty"`
+}
+
+// TopForecasts 页面上只显示最先达到容量目标的若干分区
+func (r *PartitionReport) TopForecasts() []PartitionForecast {
+	return r.Forecasts[:min(partitionForecastLimit, len(r.Forecasts))]
+}
+
+// getPartitionLoads 统计全部256个分区表的行数和大小，以及buckets表中每个分区的bucket数
+func getPartitionLoads(db *DB) ([]PartitionLoad, []string, error) {
+	loads := make(map[string]*PartitionLoad)
+	for _, part := range allPartitions() {
+		loads[part] = &PartitionLoad{Part: part}
+	}
+
+	rows, err := db.Query("SELECT part, COUNT(*) FROM buckets GROUP BY part")
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var part string
+		var n uint64
+		if err := rows.Scan(&part, &n); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		// 非法的part由数据检查页面报告，这里忽略
+		if l, ok := loads[part]; ok {
+			l.Buckets = n
+		}
+	}
+	rows.Close()
+
+	var (
+		mu   sync.Mutex
+		errs []string
+	)
+	forEachPartition(func(part string) {
+		var n, size uint64
+		query := fmt.Sprintf("SELECT COUNT(*), COALESCE(SUM(fsize), 0) FROM bucket_files_%s", part)
+		if err := db.QueryRow(query).Scan(&n, &size); err != nil {
+			slog.WarnContext(db.ctx, "Partition load failed", "part", part, "err", err)
+			mu.Lock()
+			errs = append(errs, fmt.Sprintf("partition %s: %v", part, err))
+			mu.Unlock()
+			return
+		}
+		mu.Lock()
+		loads[part].Rows = n
+		loads[part].Bytes = size
+		mu.Unlock()
+	})
+	sort.Strings(errs)
+
+	list := make([]PartitionLoad, 0, len(loads))
+	for _, part := range allPartitions() {
+		list = append(list, *loads[part])
+	}
+	return list, errs, nil
+}
+
+// getPartitionContributors 分区中占用空间最多的bucket
+func getPartitionContributors(db *DB, part string, limit int) ([]PartitionContributor, error) {
+	query := fmt.Sprintf(
+		"SELECT f.bid, COALESCE(b.bname, ''), COALESCE(b.user, 0), COUNT(*), COALESCE(SUM(f.fsize), 0) "+
+			"FROM bucket_files_%s f LEFT JOIN buckets b ON f.bid = b.bid "+
+			"GROUP BY f.bid, b.bname, b.user ORDER BY SUM(f.fsize) DESC LIMIT ?", part)
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []PartitionContributor
+	for rows.Next() {
+		var c PartitionContributor
+		if err := rows.Scan(&c.BID, &c.BName, &c.UserID, &c.Rows, &c.Bytes); err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, rows.Err()
+}
+
+// analyzePartitions 计算分区分布的偏斜程度，找出最大的hotN个分区的主要来源。
+// forecast为true时还预测各分区达到capacity的日期，需要对每个分区再做一次按天汇总，默认不做
+func analyzePartitions(db *DB, hotN int, capacity uint64, forecast bool) (*PartitionReport, error) {
+	start := time.Now()
+	loads, errs, err := getPartitionLoads(db)
+	if err != nil {
+		return nil, err
+	}
+	report := &PartitionReport{Partitions: loads, Errors: errs}
+
+	var maxRows, maxBytes, maxBuckets uint64
+	rowValues := make([]float64, len(loads))
+	byteValues := make([]float64, len(loads))
+	bucketValues := make([]float64, len(loads))
+	for i, l := range loads {
+		report.TotalRows += l.Rows
+		report.TotalBytes += l.Bytes
+		report.TotalBuckets += l.Buckets
+		maxRows = max(maxRows, l.Rows)
+		maxBytes = max(maxBytes, l.Bytes)
+		maxBuckets = max(maxBuckets, l.Buckets)
+		rowValues[i] = float64(l.Rows)
+		byteValues[i] = float64(l.Bytes)
+		bucketValues[i] = float64(l.Buckets)
+	}
+	report.RowSkew = skewStats(rowValues)
+	report.ByteSkew = skewStats(byteValues)
+	report.BucketSkew = skewStats(bucketValues)
+
+	for i := range report.Partitions {
+		l := &report.Partitions[i]
+		l.RowHeat = ratio(l.Rows, maxRows)
+		l.ByteHeat = ratio(l.Bytes, maxBytes)
+		l.BucketHeat = ratio(l.Buckets, maxBuckets)
+	}
+	report.Grid = make([][]PartitionLoad, 16)
+	for i := 0; i < 16; i++ {
+		report.Grid[i] = report.Partitions[i*16 : (i+1)*16]
+	}
+
+	// 热点分区
+	sorted := make([]PartitionLoad, len(report.Partitions))
+	copy(sorted, report.Partitions)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Bytes > sorted[j].Bytes })
+	for _, l := range sorted[:min(hotN, len(sorted))] {
+		if l.Rows == 0 {
+			break
+		}
+		contributors, err := getPartitionContributors(db, l.Part, hotPartitionContributors)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("partition %s contributors: %v", l.Part, err))
+		}
+		for i := range contributors {
+			contributors[i].Share = percentOf(contributors[i].Bytes, l.Bytes)
+		}
+		report.Hot = append(report.Hot, HotPartition{PartitionLoad: l, Contributors: contributors})
+	}
+
+	if forecast {
+		forecasts, forecastErrs := getPartitionForecasts(db, capacity)
+		report.CapacityTarget = capacity
+		report.Forecasts = forecasts
+		report.Errors = append(report.Errors, forecastErrs...)
+	}
+
+	report.Elapsed = time.Since(start).String()
+	return report, nil
+}
+
+// skewStats 计算均值、极值、标准差、max/mean和基尼系数
+func skewStats(values []float64) SkewStats {
+	var s SkewStats
+	if len(values) == 0 {
+		return s
+	}
+	s.Min = math.Inf(1)
+	var sum float64
+	for _, v := range values {
+		sum += v
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+	}
+	s.Mean = sum / float64(len(values))
+	var variance float64
+	for _, v := range values {
+		variance += (v - s.Mean) * (v - s.Mean)
+	}
+	s.StdDev = math.Sqrt(variance / float64(len(values)))
+	if s.Mean > 0 {
+		s.MaxOverMean = s.Max / s.Mean
+	}
+	s.Gini = giniCoefficient(values)
+	return s
+}
+
+// giniCoefficient 基尼系数，0表示完全均匀，接近1表示集中在少数分区
+func giniCoefficient(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+
+	var sum, weighted float64
+	for i, v := range sorted {
+		sum += v
+		weighted += float64(i+1) * v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return (2*weighted)/(float64(n)*sum) - float64(n+1)/float64(n)
+}
+
+func ratio(n, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// partitionsFromRequest 获取连接并分析分区，出错时返回HTTP状态码
+func partitionsFromRequest(r *http.Request, dbID string) (*PartitionReport, int, error) {
+	hotN := defaultHotPartitions
+	if s := r.URL.Query().Get("hot"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 256 {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid hot %q", s)
+		}
+		hotN = n
+	}
+	forecast := r.URL.Query().Get("forecast") == "1"
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	_, capacity := capacityTargets(getAppConfig())
+	report, err := analyzePartitions(db, hotN, capacity, forecast)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	report.DB = dbID
+	report.Route = &route
+	return report, http.StatusOK, nil
+}
+
+// partitionsHandler 分区均衡页面，metric参数选择热力图的指标(bytes、rows、buckets)
+func partitionsHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling partitions request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+	metric := r.URL.Query().Get("metric")
+	if metric != "rows" && metric != "buckets" {
+		metric = "bytes"
+	}
+
+	report, cache, status, err := cachedQuery(r, dbID, "partitions", []string{"hot", "forecast"}, func() (*PartitionReport, int, error) {
+		return partitionsFromRequest(r, dbID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/partitions.html", "templates/read_route.html", "templates/cache_info.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, map[string]interface{}{
+		"Configs":     cfg.Configs,
+		"SelectedDB":  dbID,
+		"Metric":      metric,
+		"Forecast":    r.URL.Query().Get("forecast") == "1",
+		"Report":      report,
+		"Cache":       cache,
+		"ElapsedTime": time.Since(startTime).String(),
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "partitionsHandler completed", "elapsed", time.Since(startTime))
+}
+
+// partitionsAPIHandler 以JSON返回分区均衡分析结果，forecast=1时包含容量预测
+func partitionsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	report, cache, status, err := cachedQuery(r, dbID, "partitions", []string{"hot", "forecast"}, func() (*PartitionReport, int, error) {
+		return partitionsFromRequest(r, dbID)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	cache.SetHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
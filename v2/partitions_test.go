@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGiniCoefficient(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   float64
+	}{
+		{"empty", nil, 0},
+		{"all zero", []float64{0, 0, 0}, 0},
+		{"uniform", []float64{5, 5, 5, 5}, 0},
+		{"linear", []float64{4, 1, 3, 2}, 0.25},
+		{"single partition holds everything", []float64{0, 0, 0, 4}, 0.75},
+	}
+	for _, tt := range tests {
+		if got := giniCoefficient(tt.values); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkewStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   SkewStats
+	}{
+		{"empty", nil, SkewStats{}},
+		{"uniform", []float64{2, 2, 2, 2}, SkewStats{Mean: 2, Min: 2, Max: 2, StdDev: 0, MaxOverMean: 1, Gini: 0}},
+		{"skewed", []float64{0, 0, 0, 4}, SkewStats{Mean: 1, Min: 0, Max: 4, StdDev: math.Sqrt(3), MaxOverMean: 4, Gini: 0.75}},
+		{"all zero", []float64{0, 0}, SkewStats{}},
+	}
+	for _, tt := range tests {
+		got := skewStats(tt.values)
+		for _, f := range []struct {
+			field     string
+			got, want float64
+		}{
+			{"Mean", got.Mean, tt.want.Mean},
+			{"Min", got.Min, tt.want.Min},
+			{"Max", got.Max, tt.want.Max},
+			{"StdDev", got.StdDev, tt.want.StdDev},
+			{"MaxOverMean", got.MaxOverMean, tt.want.MaxOverMean},
+			{"Gini", got.Gini, tt.want.Gini},
+		} {
+			if math.Abs(f.got-f.want) > 1e-9 {
+				t.Errorf("%s: %s = %v, want %v", tt.name, f.field, f.got, f.want)
+			}
+		}
+	}
+}
+
+func TestRatio(t *testing.T) {
+	if got := ratio(5, 0); got != 0 {
+		t.Errorf("ratio(5, 0) = %v, want 0", got)
+	}
+	if got := ratio(1, 4); got != 0.25 {
+		t.Errorf("ratio(1, 4) = %v, want 0.25", got)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 贪心迭代次数上限，防止配置异常时长时间计算
+const maxPlannerIterations = 100000
+
+// PlanConstraints 重新分区方案的约束条件
+type PlanConstraints struct {
+	// 最多搬迁的字节数，0表示不限制
+	MaxBytesMoved uint64 `json:"max_bytes_moved"`
+	// 最多搬迁的bucket数，0表示不限制
+	MaxMoves int `json:"max_moves"`
+	// 同一用户在同一分区的bucket作为整体搬迁到同一个目标分区
+	KeepUserTogether bool `json:"keep_user_together"`
+	// 最大分区不超过平均值的(1+Tolerance)时停止
+	Tolerance float64 `json:"tolerance"`
+}
+
+// PlannedMove 一次搬迁，KeepUserTogether时包含同一用户的多个bucket
+type PlannedMove struct {
+	UserID   uint64   `json:"user_id"`
+	BIDs     []uint64 `json:"bids"`
+	FromPart string   `json:"from_part"`
+	ToPart   string   `json:"to_part"`
+	Rows     uint64   `json:"rows"`
+	Bytes    uint64   `json:"bytes"`
+}
+
+// PartitionChange 方案执行前后分区的数据量
+type PartitionChange struct {
+	Part        string `json:"part"`
+	RowsBefore  uint64 `json:"rows_before"`
+	RowsAfter   uint64 `json:"rows_after"`
+	BytesBefore uint64 `json:"bytes_before"`
+	BytesAfter  uint64 `json:"bytes_after"`
+}
+
+// RebalancePlan 只生成方案和SQL，不会执行
+type RebalancePlan struct {
+	DB          string            `json:"db"`
+	Constraints PlanConstraints   `json:"constraints"`
+	Moves       []PlannedMove     `json:"moves"`
+	BytesMoved  uint64            `json:"bytes_moved"`
+	RowsMoved   uint64            `json:"rows_moved"`
+	Before      SkewStats         `json:"before"`
+	After       SkewStats         `json:"after"`
+	Changes     []PartitionChange `json:"changes"`
+	SQL         []string          `json:"sql"`
+	Errors      []string          `json:"errors,omitempty"`
+	Route       *ReadRoute        `json:"read_route,omitempty"`
+}
+
+// bucketLoad 单个bucket在其分区中的数据量
+type bucketLoad struct {
+	BID    uint64
+	UserID uint64
+	Part   string
+	Rows   uint64
+	Bytes  uint64
+}
+
+// moveUnit 搬迁的最小单位
+type moveUnit struct {
+	userID  uint64
+	buckets []bucketLoad
+	part    string
+	rows    uint64
+	bytes   uint64
+}
+
+// getBucketLoads 统计所有bucket在其所属分区中的数据量，只统计与buckets.part一致的文件
+func getBucketLoads(db *DB) ([]bucketLoad, []string) {
+	var (
+		mu      sync.Mutex
+		buckets []bucketLoad
+		errs    []string
+	)
+	forEachPartition(func(part string) {
+		query := fmt.Sprintf(
+			"SELECT f.bid, b.user, COUNT(*), COALESCE(SUM(f.fsize), 0) FROM bucket_files_%s f "+
+				"JOIN buckets b ON f.bid = b.bid AND b.part = ? GROUP BY f.bid, b.user", part)
+		rows, err := db.Query(query, part)
+		if err != nil {
+			mu.Lock()
+			errs = append(errs, fmt.Sprintf("partition %s: %v", part, err))
+			mu.Unlock()
+			return
+		}
+		defer rows.Close()
+
+		var list []bucketLoad
+		for rows.Next() {
+			b := bucketLoad{Part: part}
+			if err := rows.Scan(&b.BID, &b.UserID, &b.Rows, &b.Bytes); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("partition %s: %v", part, err))
+				mu.Unlock()
+				return
+			}
+			list = append(list, b)
+		}
+		mu.Lock()
+		buckets = append(buckets, list...)
+		mu.Unlock()
+	})
+	sort.Strings(errs)
+	return buckets, errs
+}
+
+// planRebalance 贪心地把最大分区中的bucket搬到最小分区，直到足够均衡或达到约束
+func planRebalance(loads []PartitionLoad, buckets []bucketLoad, c PlanConstraints) *RebalancePlan {
+	plan := &RebalancePlan{Constraints: c}
+
+	bytesByPart := make(map[string]uint64)
+	rowsByPart := make(map[string]uint64)
+	values := make([]float64, 0, len(loads))
+	var total uint64
+	for _, l := range loads {
+		bytesByPart[l.Part] = l.Bytes
+		rowsByPart[l.Part] = l.Rows
+		values = append(values, float64(l.Bytes))
+		total += l.Bytes
+	}
+	plan.Before = skewStats(values)
+	if len(loads) == 0 {
+		return plan
+	}
+	mean := float64(total) / float64(len(loads))
+
+	// 按分区组织搬迁单位，每个分区内按大小降序
+	units := make(map[string][]*moveUnit)
+	if c.KeepUserTogether {
+		byUser := make(map[string]*moveUnit)
+		for _, b := range buckets {
+			key := b.Part + "/" + strconv.FormatUint(b.UserID, 10)
+			u := byUser[key]
+			if u == nil {
+				u = &moveUnit{userID: b.UserID, part: b.Part}
+				byUser[key] = u
+				units[b.Part] = append(units[b.Part], u)
+			}
+			u.buckets = append(u.buckets, b)
+			u.rows += b.Rows
+			u.bytes += b.Bytes
+		}
+	} else {
+		for _, b := range buckets {
+			units[b.Part] = append(units[b.Part], &moveUnit{userID: b.UserID, part: b.Part, buckets: []bucketLoad{b}, rows: b.Rows, bytes: b.Bytes})
+		}
+	}
+	for _, list := range units {
+		sort.Slice(list, func(i, j int) bool { return list[i].bytes > list[j].bytes })
+	}
+
+	moves := 0
+	for iter := 0; iter < maxPlannerIterations; iter++ {
+		src, dst := extremePartitions(loads, bytesByPart)
+		if float64(bytesByPart[src]) <= mean*(1+c.Tolerance) {
+			break
+		}
+		gap := bytesByPart[src] - bytesByPart[dst]
+
+		// 选择能缩小差距的最大单位，优先不超过差距一半的(搬完后src仍不小于dst)
+		best := -1
+		for i, u := range units[src] {
+			if u.bytes == 0 || u.bytes >= gap {
+				continue
+			}
+			if c.MaxBytesMoved > 0 && plan.BytesMoved+u.bytes > c.MaxBytesMoved {
+				continue
+			}
+			if c.MaxMoves > 0 && moves+len(u.buckets) > c.MaxMoves {
+				continue
+			}
+			if u.bytes*2 <= gap {
+				best = i
+				break
+			}
+			if best == -1 {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		u := units[src][best]
+		units[src] = append(units[src][:best], units[src][best+1:]...)
+		bytesByPart[src] -= u.bytes
+		bytesByPart[dst] += u.bytes
+		rowsByPart[src] -= u.rows
+		rowsByPart[dst] += u.rows
+		plan.BytesMoved += u.bytes
+		plan.RowsMoved += u.rows
+		moves += len(u.buckets)
+
+		move := PlannedMove{UserID: u.userID, FromPart: src, ToPart: dst, Rows: u.rows, Bytes: u.bytes}
+		for _, b := range u.buckets {
+			move.BIDs = append(move.BIDs, b.BID)
+		}
+		plan.Moves = append(plan.Moves, move)
+	}
+
+	values = values[:0]
+	for _, l := range loads {
+		values = append(values, float64(bytesByPart[l.Part]))
+		if bytesByPart[l.Part] != l.Bytes {
+			plan.Changes = append(plan.Changes, PartitionChange{
+				Part:        l.Part,
+				RowsBefore:  l.Rows,
+				RowsAfter:   rowsByPart[l.Part],
+				BytesBefore: l.Bytes,
+				BytesAfter:  bytesByPart[l.Part],
+			})
+		}
+	}
+	plan.After = skewStats(values)
+	plan.SQL = rebalanceSQL(plan.Moves)
+	return plan
+}
+
+// extremePartitions 返回当前最大和最小的分区
+func extremePartitions(loads []PartitionLoad, bytesByPart map[string]uint64) (string, string) {
+	src, dst := loads[0].Part, loads[0].Part
+	for _, l := range loads[1:] {
+		if bytesByPart[l.Part] > bytesByPart[src] {
+			src = l.Part
+		}
+		if bytesByPart[l.Part] < bytesByPart[dst] {
+			dst = l.Part
+		}
+	}
+	return src, dst
+}
+
+// rebalanceSQL 为每个bucket生成搬迁语句，每个bucket一个事务
+func rebalanceSQL(moves []PlannedMove) []string {
+	var stmts []string
+	for _, m := range moves {
+		for _, bid := range m.BIDs {
+			stmts = append(stmts, strings.Join([]string{
+				fmt.Sprintf("-- bucket %d (user %d): %s -> %s", bid, m.UserID, m.FromPart, m.ToPart),
+				"START TRANSACTION;",
+				fmt.Sprintf("INSERT INTO bucket_files_%s SELECT * FROM bucket_files_%s WHERE bid = %d;", m.ToPart, m.FromPart, bid),
+				fmt.Sprintf("DELETE FROM bucket_files_%s WHERE bid = %d;", m.FromPart, bid),
+				fmt.Sprintf("UPDATE buckets SET part = '%s' WHERE bid = %d AND part = '%s';", m.ToPart, bid, m.FromPart),
+				"COMMIT;",
+			}, "\n"))
+		}
+	}
+	return stmts
+}
+
+// planConstraintsFromRequest 解析约束参数，max_bytes_moved以MB为单位，tolerance为百分比
+func planConstraintsFromRequest(r *http.Request) (PlanConstraints, error) {
+	q := r.URL.Query()
+	c := PlanConstraints{Tolerance: 0.1, KeepUserTogether: q.Get("keep_user_together") == "1"}
+	if s := q.Get("max_bytes_moved"); s != "" {
+		mb, err := strconv.ParseFloat(s, 64)
+		if err != nil || mb < 0 {
+			return c, fmt.Errorf("invalid max_bytes_moved %q", s)
+		}
+		c.MaxBytesMoved = uint64(mb * 1024 * 1024)
+	}
+	if s := q.Get("max_moves"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid max_moves %q", s)
+		}
+		c.MaxMoves = n
+	}
+	if s := q.Get("tolerance"); s != "" {
+		pct, err := strconv.ParseFloat(s, 64)
+		if err != nil || pct < 0 {
+			return c, fmt.Errorf("invalid tolerance %q", s)
+		}
+		c.Tolerance = pct / 100
+	}
+	return c, nil
+}
+
+// planFromRequest 获取连接并生成方案，出错时返回HTTP状态码
+func planFromRequest(r *http.Request, dbID string) (*RebalancePlan, int, error) {
+	c, err := planConstraintsFromRequest(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	db, release, route, err := getReadDB(r.Context(), dbID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	loads, errs, err := getPartitionLoads(db)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	buckets, bucketErrs := getBucketLoads(db)
+	errs = append(errs, bucketErrs...)
+	if len(errs) > 0 {
+		// 分区数据不完整时生成的方案不可靠
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to load partitions: %s", strings.Join(errs, "; "))
+	}
+
+	plan := planRebalance(loads, buckets, c)
+	plan.DB = dbID
+	plan.Route = &route
+	return plan, http.StatusOK, nil
+}
+
+// planHandler 重新分区方案页面，format=sql时下载SQL文件
+func planHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling partition plan request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	cfg := getAppConfig()
+	dbID, ok := selectDBConfig(w, r, cfg)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	data := map[string]interface{}{
+		"Configs":          cfg.Configs,
+		"SelectedDB":       dbID,
+		"MaxBytesMoved":    q.Get("max_bytes_moved"),
+		"MaxMoves":         q.Get("max_moves"),
+		"Tolerance":        q.Get("tolerance"),
+		"KeepUserTogether": q.Get("keep_user_together") == "1",
+	}
+	if q.Get("run") == "1" {
+		plan, status, err := planFromRequest(r, dbID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if q.Get("format") == "sql" {
+			w.Header().Set("Content-Type", "application/sql")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=rebalance_%s.sql", dbID))
+			fmt.Fprintf(w, "-- Rebalance plan for %s, generated at %s. Review before running.\n\n", dbID, time.Now().Format(time.RFC3339))
+			for _, stmt := range plan.SQL {
+				fmt.Fprintf(w, "%s\n\n", stmt)
+			}
+			return
+		}
+		data["Plan"] = plan
+		data["SQLText"] = strings.Join(plan.SQL, "\n\n")
+		data["ElapsedTime"] = time.Since(startTime).String()
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/plan.html", "templates/read_route.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "planHandler completed", "elapsed", time.Since(startTime))
+}
+
+// planAPIHandler 以JSON返回重新分区方案
+func planAPIHandler(w http.ResponseWriter, r *http.Request) {
+	dbID, ok := selectDBConfig(w, r, getAppConfig())
+	if !ok {
+		return
+	}
+	plan, status, err := planFromRequest(r, dbID)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
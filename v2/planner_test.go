@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// 分区00偏大: 用户1的bucket 1、2和用户2的bucket 3，平均每分区400字节
+var (
+	plannerLoads = []PartitionLoad{
+		{Part: "00", Rows: 10, Bytes: 1000},
+		{Part: "01", Rows: 0, Bytes: 0},
+		{Part: "02", Rows: 2, Bytes: 200},
+	}
+	plannerBuckets = []bucketLoad{
+		{BID: 1, UserID: 1, Part: "00", Rows: 4, Bytes: 400},
+		{BID: 2, UserID: 1, Part: "00", Rows: 3, Bytes: 300},
+		{BID: 3, UserID: 2, Part: "00", Rows: 3, Bytes: 300},
+		{BID: 4, UserID: 3, Part: "02", Rows: 2, Bytes: 200},
+	}
+)
+
+func TestPlanRebalance(t *testing.T) {
+	tests := []struct {
+		name        string
+		loads       []PartitionLoad
+		constraints PlanConstraints
+		want        []PlannedMove
+	}{
+		{
+			name:  "already balanced within tolerance",
+			loads: []PartitionLoad{{Part: "00", Bytes: 1000}, {Part: "01", Bytes: 900}},
+			constraints: PlanConstraints{
+				Tolerance: 0.1,
+			},
+			want: nil,
+		},
+		{
+			name:  "moves largest fitting buckets to the smallest partition",
+			loads: plannerLoads,
+			want: []PlannedMove{
+				{UserID: 1, BIDs: []uint64{1}, FromPart: "00", ToPart: "01", Rows: 4, Bytes: 400},
+				{UserID: 1, BIDs: []uint64{2}, FromPart: "00", ToPart: "02", Rows: 3, Bytes: 300},
+			},
+		},
+		{
+			name:        "max moves",
+			loads:       plannerLoads,
+			constraints: PlanConstraints{MaxMoves: 1},
+			want: []PlannedMove{
+				{UserID: 1, BIDs: []uint64{1}, FromPart: "00", ToPart: "01", Rows: 4, Bytes: 400},
+			},
+		},
+		{
+			name:        "max bytes moved",
+			loads:       plannerLoads,
+			constraints: PlanConstraints{MaxBytesMoved: 350},
+			want: []PlannedMove{
+				{UserID: 1, BIDs: []uint64{2}, FromPart: "00", ToPart: "01", Rows: 3, Bytes: 300},
+			},
+		},
+		{
+			// 用户1的两个bucket共700字节，只能整体搬迁
+			name:        "keep user together",
+			loads:       plannerLoads,
+			constraints: PlanConstraints{KeepUserTogether: true},
+			want: []PlannedMove{
+				{UserID: 2, BIDs: []uint64{3}, FromPart: "00", ToPart: "01", Rows: 3, Bytes: 300},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planRebalance(tt.loads, plannerBuckets, tt.constraints)
+			if !reflect.DeepEqual(plan.Moves, tt.want) {
+				t.Fatalf("moves:\n%+v\nwant:\n%+v", plan.Moves, tt.want)
+			}
+
+			var moved, before, after uint64
+			for _, m := range plan.Moves {
+				moved += m.Bytes
+			}
+			if plan.BytesMoved != moved {
+				t.Errorf("BytesMoved = %d, want %d", plan.BytesMoved, moved)
+			}
+			changed := make(map[string]PartitionChange)
+			for _, c := range plan.Changes {
+				changed[c.Part] = c
+			}
+			for _, l := range tt.loads {
+				before += l.Bytes
+				if c, ok := changed[l.Part]; ok {
+					after += c.BytesAfter
+				} else {
+					after += l.Bytes
+				}
+			}
+			if before != after {
+				t.Errorf("total bytes changed from %d to %d", before, after)
+			}
+			if plan.After.Max > plan.Before.Max {
+				t.Errorf("largest partition grew from %.0f to %.0f", plan.Before.Max, plan.After.Max)
+			}
+			if len(plan.SQL) != len(plan.Moves) {
+				t.Errorf("got %d SQL statements for %d moves", len(plan.SQL), len(plan.Moves))
+			}
+		})
+	}
+}
+
+func TestPlanRebalanceNoPartitions(t *testing.T) {
+	plan := planRebalance(nil, nil, PlanConstraints{})
+	if len(plan.Moves) != 0 || len(plan.SQL) != 0 {
+		t.Errorf("expected empty plan, got %+v", plan)
+	}
+}
+
+func TestRebalanceSQL(t *testing.T) {
+	stmts := rebalanceSQL([]PlannedMove{{UserID: 9, BIDs: []uint64{5, 6}, FromPart: "0a", ToPart: "1b"}})
+	if len(stmts) != 2 {
+		t.Fatalf("got %d statements, want one per bucket", len(stmts))
+	}
+	want := strings.Join([]string{
+		"-- bucket 6 (user 9): 0a -> 1b",
+		"START TRANSACTION;",
+		"INSERT INTO bucket_files_1b SELECT * FROM bucket_files_0a WHERE bid = 6;",
+		"DELETE FROM bucket_files_0a WHERE bid = 6;",
+		"UPDATE buckets SET part = '1b' WHERE bid = 6 AND part = '0a';",
+		"COMMIT;",
+	}, "\n")
+	if stmts[1] != want {
+		t.Errorf("got:\n%s\nwant:\n%s", stmts[1], want)
+	}
+}
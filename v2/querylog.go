@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 保留最近的查询数
+	recentQueryLimit = 500
+	// 保留耗时最长的查询数
+	slowestQueryLimit = 50
+	// 未配置slow_query_ms时超过多少毫秒记为慢查询，以warn级别写入日志
+	defaultSlowQuery = time.Second
+)
+
+// QueryRecord 一次查询的执行情况，耗时包括读取全部结果的时间
+type QueryRecord struct {
+	ID     uint64 `json:"id"`
+	DB     string `json:"db"`
+	Origin string `json:"origin"` // 发起查询的请求路径或后台任务
+	// 发起查询的请求ID，后台任务为空
+	RequestID string        `json:"request_id,omitempty"`
+	Query     string        `json:"query"`
+	Args      []interface{} `json:"args,omitempty"`
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Rows      int64         `json:"rows"`
+	Error     string        `json:"error,omitempty"`
+}
+
+func (q QueryRecord) DurationMs() float64 {
+	return float64(q.Duration.Microseconds()) / 1000
+}
+
+// ArgsText 页面显示用的参数
+func (q QueryRecord) ArgsText() string {
+	if len(q.Args) == 0 {
+		return ""
+	}
+	return fmt.Sprint(q.Args...)
+}
+
+// QueryLog 保存最近的查询和耗时最长的查询
+type QueryLog struct {
+	mu      sync.Mutex
+	nextID  uint64
+	recent  []QueryRecord // 环形缓冲区
+	next    int
+	slowest []QueryRecord // 按耗时降序
+}
+
+var queryLog = &QueryLog{}
+
+func (l *QueryLog) add(rec QueryRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	rec.ID = l.nextID
+	if len(l.recent) < recentQueryLimit {
+		l.recent = append(l.recent, rec)
+	} else {
+		l.recent[l.next] = rec
+	}
+	l.next = (l.next + 1) % recentQueryLimit
+
+	if len(l.slowest) < slowestQueryLimit || rec.Duration > l.slowest[len(l.slowest)-1].Duration {
+		i := sort.Search(len(l.slowest), func(i int) bool { return l.slowest[i].Duration < rec.Duration })
+		l.slowest = append(l.slowest, QueryRecord{})
+		copy(l.slowest[i+1:], l.slowest[i:])
+		l.slowest[i] = rec
+		if len(l.slowest) > slowestQueryLimit {
+			l.slowest = l.slowest[:slowestQueryLimit]
+		}
+	}
+}
+
+// Recent 最近的查询，新的在前
+func (l *QueryLog) Recent() []QueryRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]QueryRecord, 0, len(l.recent))
+	for i := 1; i <= len(l.recent); i++ {
+		out = append(out, l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+	return out
+}
+
+// Slowest 耗时最长的查询
+func (l *QueryLog) Slowest() []QueryRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]QueryRecord(nil), l.slowest...)
+}
+
+// Find 按ID查找仍保留的查询
+func (l *QueryLog) Find(id uint64) (QueryRecord, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, list := range [][]QueryRecord{l.recent, l.slowest} {
+		for _, q := range list {
+			if q.ID == id {
+				return q, true
+			}
+		}
+	}
+	return QueryRecord{}, false
+}
+
+// Reset 清空记录
+func (l *QueryLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recent, l.slowest, l.next = nil, nil, 0
+}
+
+type queryOriginKey struct{}
+
+// withQueryOrigin 在context中记录查询的来源
+func withQueryOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, queryOriginKey{}, origin)
+}
+
+func queryOrigin(ctx context.Context) string {
+	origin, _ := ctx.Value(queryOriginKey{}).(string)
+	return origin
+}
+
+// queryOriginMiddleware 把请求路径作为该请求中所有查询的来源
+func queryOriginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(withQueryOrigin(r.Context(), r.URL.Path)))
+	})
+}
+
+// DB 连接池加上查询来源，通过它执行的查询都记录到queryLog
+type DB struct {
+	*sql.DB
+	id  string
+	ctx context.Context
+}
+
+// newDB 查询不随请求取消，ctx只用于传递来源等信息
+func newDB(ctx context.Context, id string, db *sql.DB) *DB {
+	return &DB{DB: db, id: id, ctx: context.WithoutCancel(ctx)}
+}
+
+// queryRecorder 查询结束时写入queryLog
+type queryRecorder struct {
+	ctx context.Context
+	rec QueryRecord
+}
+
+func (d *DB) record(query string, args []interface{}) *queryRecorder {
+	return &queryRecorder{ctx: d.ctx, rec: QueryRecord{
+		DB:        d.id,
+		Origin:    queryOrigin(d.ctx),
+		RequestID: requestID(d.ctx),
+		Query:     query,
+		Args:      append([]interface{}(nil), args...),
+		Started:   time.Now(),
+	}}
+}
+
+func (r *queryRecorder) finish(rows int64, err error) {
+	r.rec.Duration = time.Since(r.rec.Started)
+	r.rec.Rows = rows
+	if err != nil {
+		r.rec.Error = err.Error()
+	}
+	level := slog.LevelDebug
+	if r.rec.Duration >= slowQueryThreshold(getAppConfig()) {
+		level = slog.LevelWarn
+	}
+	attrs := []interface{}{"db", r.rec.DB, "origin", r.rec.Origin, "elapsed", r.rec.Duration, "rows", rows, "query", r.rec.Query}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	slog.Log(r.ctx, level, "Query executed", attrs...)
+	queryLog.add(r.rec)
+}
+
+func slowQueryThreshold(cfg AppConfig) time.Duration {
+	if cfg.SlowQueryMs > 0 {
+		return time.Duration(cfg.SlowQueryMs) * time.Millisecond
+	}
+	return defaultSlowQuery
+}
+
+func (d *DB) Query(query string, args ...interface{}) (*Rows, error) {
+	return d.QueryContext(d.ctx, query, args...)
+}
+
+func (d *DB) QueryContext(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	rec := d.record(query, args)
+	rows, err := d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		rec.finish(0, err)
+		return nil, err
+	}
+	return &Rows{Rows: rows, rec: rec}, nil
+}
+
+func (d *DB) QueryRow(query string, args ...interface{}) *Row {
+	return d.QueryRowContext(d.ctx, query, args...)
+}
+
+func (d *DB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	rec := d.record(query, args)
+	return &Row{Row: d.DB.QueryRowContext(ctx, query, args...), rec: rec}
+}
+
+// Rows 统计读取的行数，读完或关闭时记录查询
+type Rows struct {
+	*sql.Rows
+	rec  *queryRecorder
+	n    int64
+	done bool
+}
+
+func (r *Rows) Next() bool {
+	if r.Rows.Next() {
+		r.n++
+		return true
+	}
+	r.finish()
+	return false
+}
+
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	r.finish()
+	return err
+}
+
+func (r *Rows) finish() {
+	if !r.done {
+		r.done = true
+		r.rec.finish(r.n, r.Rows.Err())
+	}
+}
+
+// Row Scan时记录查询
+type Row struct {
+	*sql.Row
+	rec *queryRecorder
+}
+
+func (r *Row) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	switch {
+	case err == nil:
+		r.rec.finish(1, nil)
+	case errors.Is(err, sql.ErrNoRows):
+		r.rec.finish(0, nil)
+	default:
+		r.rec.finish(0, err)
+	}
+	return err
+}
+
+// isAdmin 请求带有配置的admin_token时为管理员，未配置时没有管理员。
+// 令牌只从X-Admin-Token请求头或POST表单读取，不接受URL参数，避免出现在访问日志和浏览器历史中
+func isAdmin(r *http.Request) bool {
+	token := getAppConfig().AdminToken
+	if token == "" {
+		return false
+	}
+	got := r.Header.Get("X-Admin-Token")
+	if got == "" && r.Method == http.MethodPost {
+		got = r.PostFormValue("admin_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// ExplainResult EXPLAIN的输出
+type ExplainResult struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// explainQuery 在原来的数据库上对记录的SELECT查询执行EXPLAIN
+func explainQuery(ctx context.Context, q QueryRecord) (*ExplainResult, error) {
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(q.Query)), "SELECT") {
+		return nil, errors.New("only SELECT queries can be explained")
+	}
+	db, release, err := dbManager.Get(ctx, q.DB)
+	if err != nil {
+		return nil, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	rows, err := db.Query("EXPLAIN "+q.Query, q.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	res := &ExplainResult{Columns: cols}
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(cols))
+		for i, v := range values {
+			if v.Valid {
+				row[i] = v.String
+			} else {
+				row[i] = "NULL"
+			}
+		}
+		res.Rows = append(res.Rows, row)
+	}
+	return res, rows.Err()
+}
+
+// withoutArgs 去掉查询参数，参数中可能有用户名、文件名等，只显示给管理员
+func withoutArgs(queries []QueryRecord) []QueryRecord {
+	out := make([]QueryRecord, len(queries))
+	for i, q := range queries {
+		q.Args = nil
+		out[i] = q
+	}
+	return out
+}
+
+// debugQueriesHandler 最近和最慢的查询，查询参数只显示给管理员。
+// 管理员可以POST explain=<id>查看执行计划、reset=1清空记录，其他POST只显示参数
+func debugQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling debug queries request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	data := map[string]interface{}{
+		"AdminEnabled":  getAppConfig().AdminToken != "",
+		"SlowThreshold": slowQueryThreshold(getAppConfig()).String(),
+		"LogLevel":      strings.ToLower(logLevel.Level().String()),
+		"LogLevels":     []string{"debug", "info", "warn", "error"},
+	}
+	admin := isAdmin(r)
+	if r.Method == http.MethodPost {
+		if !admin {
+			http.Error(w, "admin token required", http.StatusForbidden)
+			return
+		}
+		if r.PostFormValue("reset") == "1" {
+			queryLog.Reset()
+			http.Redirect(w, r, "/debug/queries", http.StatusSeeOther)
+			return
+		}
+		if s := r.PostFormValue("explain"); s != "" {
+			id, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid query id", http.StatusBadRequest)
+				return
+			}
+			q, ok := queryLog.Find(id)
+			if !ok {
+				http.Error(w, "query no longer in the log", http.StatusNotFound)
+				return
+			}
+			data["Explained"] = q
+			if res, err := explainQuery(r.Context(), q); err != nil {
+				data["ExplainError"] = err.Error()
+			} else {
+				data["Explain"] = res
+			}
+		}
+	}
+	data["Admin"] = admin
+	slowest, recent := queryLog.Slowest(), queryLog.Recent()
+	if !admin {
+		slowest, recent = withoutArgs(slowest), withoutArgs(recent)
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"slowest": slowest,
+			"recent":  recent,
+		})
+		return
+	}
+
+	// 表格模板中需要知道是否显示EXPLAIN按钮
+	type queryTable struct {
+		Queries []QueryRecord
+		Admin   bool
+	}
+	explain := data["AdminEnabled"].(bool)
+	data["Slowest"], data["SlowestTable"] = slowest, queryTable{slowest, explain}
+	data["Recent"], data["RecentTable"] = recent, queryTable{recent, explain}
+
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/debug_queries.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data["ElapsedTime"] = time.Since(startTime).String()
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "debugQueriesHandler completed", "elapsed", time.Since(startTime))
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 未配置max_replica_lag时允许的最大复制延迟
+const defaultMaxReplicaLag = 60 * time.Second
+
+// 从库在DBManager中的连接池ID为 <配置ID>@replica<下标>，'@'不会出现在配置ID中
+const replicaIDSep = "@replica"
+
+func replicaID(id string, index int) string {
+	return id + replicaIDSep + strconv.Itoa(index)
+}
+
+// parseReplicaID 解析从库连接池ID
+func parseReplicaID(id string) (string, int, bool) {
+	base, idx, ok := strings.Cut(id, replicaIDSep)
+	if !ok {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(idx)
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+	return base, n, true
+}
+
+// replicaConfig 返回第i个从库的连接配置，未设置的用户名密码沿用主库
+func (c Config) replicaConfig(i int) Config {
+	r := c.Replicas[i]
+	rc := c
+	rc.ID = replicaID(c.ID, i)
+	rc.Host, rc.Port = r.Host, r.Port
+	if r.User != "" {
+		rc.User, rc.Password = r.User, r.Password
+	}
+	rc.Replicas = nil
+	return rc
+}
+
+// ReplicaHealth 从库的健康状态和复制延迟
+type ReplicaHealth struct {
+	Index      int       `json:"index"`
+	Addr       string    `json:"addr"`
+	OK         bool      `json:"ok"`
+	LagSeconds *int64    `json:"lag_seconds,omitempty"` // 复制未运行时为空
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// LagText 页面显示用的复制延迟
+func (r ReplicaHealth) LagText() string {
+	return lagText(r.LagSeconds)
+}
+
+func lagText(lag *int64) string {
+	if lag == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%ds", *lag)
+}
+
+// checkReplicas 并发检查所有从库
+func checkReplicas(c Config) []ReplicaHealth {
+	if len(c.Replicas) == 0 {
+		return nil
+	}
+	results := make([]ReplicaHealth, len(c.Replicas))
+	var wg sync.WaitGroup
+	for i := range c.Replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checkReplica(c.replicaConfig(i), i)
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// checkReplica 使用临时连接检查从库是否可用，并读取复制延迟
+func checkReplica(rc Config, index int) ReplicaHealth {
+	res := ReplicaHealth{Index: index, Addr: configAddr(rc), CheckedAt: time.Now()}
+	fail := func(err error) ReplicaHealth {
+		slog.Warn("Health check for replica failed", "db", rc.ID, "addr", res.Addr, "err", err)
+		res.Error = err.Error()
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	db, err := connectDB(rc)
+	if err != nil {
+		return fail(err)
+	}
+	defer db.Close()
+	if err := db.PingContext(ctx); err != nil {
+		return fail(err)
+	}
+	lag, err := replicationLag(ctx, db)
+	if err != nil {
+		return fail(err)
+	}
+	res.LagSeconds = &lag
+	res.OK = true
+	return res
+}
+
+// replicationLag 读取复制延迟(秒)，MySQL 8.0.22之前的版本使用SHOW SLAVE STATUS
+func replicationLag(ctx context.Context, db *sql.DB) (int64, error) {
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		rows, err = db.QueryContext(ctx, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("not configured as a replica")
+	}
+	values := make([]sql.NullString, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, col := range cols {
+		if col != "Seconds_Behind_Source" && col != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("replication is not running")
+		}
+		return strconv.ParseInt(values[i].String, 10, 64)
+	}
+	return 0, errors.New("replication lag not reported")
+}
+
+// ReadRoute 统计查询实际使用的数据库，显示在结果旁边
+type ReadRoute struct {
+	DB         string `json:"db"`
+	Source     string `json:"source"` // primary 或 replica
+	Addr       string `json:"addr"`
+	LagSeconds *int64 `json:"lag_seconds,omitempty"`
+	// 配置了从库但没有使用时的原因
+	Fallback string `json:"fallback,omitempty"`
+}
+
+func (r ReadRoute) LagText() string {
+	return lagText(r.LagSeconds)
+}
+
+// 多个可用从库时轮流使用
+var replicaCounter atomic.Uint64
+
+// getReadDB 为统计查询获取连接：依次尝试健康且延迟不超过上限的从库，都不可用时使用主库。
+// 返回的release函数必须在使用完后调用。
+func getReadDB(ctx context.Context, id string) (*DB, func(), ReadRoute, error) {
+	cfg := getAppConfig()
+	route := ReadRoute{DB: id, Source: "primary"}
+	c, ok := cfg.findConfig(id)
+	if ok {
+		route.Addr = configAddr(c)
+	}
+
+	if ok && len(c.Replicas) > 0 {
+		maxLag := defaultMaxReplicaLag
+		if cfg.MaxReplicaLag > 0 {
+			maxLag = time.Duration(cfg.MaxReplicaLag) * time.Second
+		}
+		var healths []ReplicaHealth
+		if healthMonitor != nil {
+			healths = healthMonitor.ReplicaHealth(id)
+		}
+
+		route.Fallback = "no healthy replica"
+		start := int(replicaCounter.Add(1))
+		for k := range healths {
+			h := healths[(start+k)%len(healths)]
+			// 检查结果可能来自修改前的配置
+			if h.Index >= len(c.Replicas) || h.Addr != configAddr(c.replicaConfig(h.Index)) {
+				continue
+			}
+			if !h.OK || h.LagSeconds == nil {
+				continue
+			}
+			if time.Duration(*h.LagSeconds)*time.Second > maxLag {
+				route.Fallback = fmt.Sprintf("replica lag %s exceeds %v", h.LagText(), maxLag)
+				continue
+			}
+			db, release, err := dbManager.Get(ctx, replicaID(id, h.Index))
+			if err != nil {
+				slog.WarnContext(ctx, "Replica unavailable, trying next", "addr", h.Addr, "err", err)
+				continue
+			}
+			return db, release, ReadRoute{DB: id, Source: "replica", Addr: h.Addr, LagSeconds: h.LagSeconds}, nil
+		}
+	}
+
+	db, release, err := dbManager.Get(ctx, id)
+	if err != nil {
+		return nil, nil, route, err
+	}
+	return db, release, route, nil
+}
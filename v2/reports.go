@@ -0,0 +1,588 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 调度器检查的间隔
+	reportCheckInterval = 30 * time.Second
+	// 邮件正文中最多显示的行数，完整数据在CSV附件中
+	maxReportHTMLRows = 200
+	// 保留的运行记录条数
+	maxReportRuns = 200
+	// every调度的最小间隔
+	minReportInterval = time.Minute
+)
+
+// SMTPConfig 发送报表邮件的SMTP服务器
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	From     string `json:"from"`
+}
+
+// ReportDefinition 定时报表，View和Filters与导出功能相同
+type ReportDefinition struct {
+	Name    string            `json:"name"`
+	View    string            `json:"view"` // users, buckets 或 files
+	Filters map[string]string `json:"filters,omitempty"`
+	// 为空时使用默认库
+	DB string `json:"db,omitempty"`
+	// hourly, daily HH:MM, weekly <mon..sun> HH:MM 或 every <duration>
+	Schedule   string   `json:"schedule"`
+	Recipients []string `json:"recipients"`
+}
+
+// ReportRun 一次报表运行的记录
+type ReportRun struct {
+	Report     string    `json:"report"`
+	DB         string    `json:"db"`
+	Trigger    string    `json:"trigger"` // schedule 或 manual
+	Status     string    `json:"status"`  // running, ok, failed
+	Rows       int       `json:"rows"`
+	Recipients []string  `json:"recipients"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// nextReportRun 返回after之后的下一次运行时间
+func nextReportRun(schedule string, after time.Time) (time.Time, error) {
+	fields := strings.Fields(strings.ToLower(schedule))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("empty schedule")
+	}
+	parseClock := func(s string) (int, int, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+		}
+		return t.Hour(), t.Minute(), nil
+	}
+
+	switch {
+	case fields[0] == "hourly" && len(fields) == 1:
+		return after.Truncate(time.Hour).Add(time.Hour), nil
+	case fields[0] == "every" && len(fields) == 2:
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid interval %q", fields[1])
+		}
+		if d < minReportInterval {
+			return time.Time{}, fmt.Errorf("interval %v is shorter than %v", d, minReportInterval)
+		}
+		return after.Add(d), nil
+	case fields[0] == "daily" && len(fields) == 2:
+		h, m, err := parseClock(fields[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := time.Date(after.Year(), after.Month(), after.Day(), h, m, 0, 0, after.Location())
+		if !next.After(after) {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next, nil
+	case fields[0] == "weekly" && len(fields) == 3:
+		day, ok := weekdays[fields[1][:min(3, len(fields[1]))]]
+		if !ok {
+			return time.Time{}, fmt.Errorf("invalid weekday %q", fields[1])
+		}
+		h, m, err := parseClock(fields[2])
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := time.Date(after.Year(), after.Month(), after.Day(), h, m, 0, 0, after.Location())
+		next = next.AddDate(0, 0, (int(day)-int(next.Weekday())+7)%7)
+		if !next.After(after) {
+			next = next.AddDate(0, 0, 7)
+		}
+		return next, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid schedule %q, expected hourly, daily HH:MM, weekly <day> HH:MM or every <duration>", schedule)
+}
+
+// validateReports 检查报表定义和SMTP配置，dbIDs为已配置的数据库
+func validateReports(cfg AppConfig, dbIDs map[string]bool) error {
+	names := make(map[string]bool)
+	for i, r := range cfg.Reports {
+		if !configIDPattern.MatchString(r.Name) {
+			return fmt.Errorf("report %d: invalid name %q", i, r.Name)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("report %d: duplicate name %q", i, r.Name)
+		}
+		names[r.Name] = true
+		view, ok := exportViews[r.View]
+		if !ok {
+			return fmt.Errorf("report %s: view must be one of users, buckets, files", r.Name)
+		}
+		// 过滤条件无效时在加载配置时报错，而不是等到发送时才失败
+		filters := url.Values{}
+		for k, v := range r.Filters {
+			filters.Set(k, v)
+		}
+		if _, _, err := view.query(filters); err != nil {
+			return fmt.Errorf("report %s: %w", r.Name, err)
+		}
+		if r.DB != "" && !dbIDs[r.DB] {
+			return fmt.Errorf("report %s: database %q not found in configs", r.Name, r.DB)
+		}
+		if _, err := nextReportRun(r.Schedule, time.Now()); err != nil {
+			return fmt.Errorf("report %s: %w", r.Name, err)
+		}
+		if len(r.Recipients) == 0 {
+			return fmt.Errorf("report %s: no recipients", r.Name)
+		}
+		for _, addr := range r.Recipients {
+			if _, err := mail.ParseAddress(addr); err != nil {
+				return fmt.Errorf("report %s: invalid recipient %q", r.Name, addr)
+			}
+		}
+	}
+	if len(cfg.Reports) > 0 {
+		if cfg.SMTP == nil || cfg.SMTP.Host == "" || cfg.SMTP.From == "" {
+			return fmt.Errorf("smtp host and from are required when reports are configured")
+		}
+		if cfg.SMTP.Port <= 0 || cfg.SMTP.Port > 65535 {
+			return fmt.Errorf("smtp: invalid port %d", cfg.SMTP.Port)
+		}
+		if _, err := mail.ParseAddress(cfg.SMTP.From); err != nil {
+			return fmt.Errorf("smtp: invalid from address %q", cfg.SMTP.From)
+		}
+	}
+	return nil
+}
+
+// reportCollector 把导出行同时写入CSV附件，并保留前maxReportHTMLRows行用于邮件正文
+type reportCollector struct {
+	csv     exportWriter
+	columns []string
+	rows    [][]string
+	total   int
+}
+
+func (c *reportCollector) WriteHeader(columns []string) error {
+	c.columns = columns
+	return c.csv.WriteHeader(columns)
+}
+
+func (c *reportCollector) WriteRow(values []interface{}) error {
+	c.total++
+	if len(c.rows) < maxReportHTMLRows {
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = fmt.Sprint(v)
+		}
+		c.rows = append(c.rows, row)
+	}
+	return c.csv.WriteRow(values)
+}
+
+func (c *reportCollector) Flush() error { return c.csv.Flush() }
+
+func (c *reportCollector) Close() error { return c.csv.Close() }
+
+// renderReport 查询报表数据，返回HTML正文、CSV附件和行数
+func renderReport(def ReportDefinition, dbID string) ([]byte, []byte, int, error) {
+	view := exportViews[def.View]
+	q := url.Values{}
+	for k, v := range def.Filters {
+		q.Set(k, v)
+	}
+	query, args, err := view.query(q)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	db, release, err := dbManager.Get(withQueryOrigin(context.Background(), "report "+def.Name), dbID)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("database connection not available: %w", err)
+	}
+	defer release()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer rows.Close()
+
+	var csvBuf bytes.Buffer
+	c := &reportCollector{csv: newCSVExportWriter(&csvBuf)}
+	if _, err := writeExportRows(db, view, rows, c, nil); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, nil, 0, err
+	}
+
+	tmpl, err := template.ParseFS(templates, "templates/report_email.html")
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	var htmlBuf bytes.Buffer
+	if err := tmpl.Execute(&htmlBuf, map[string]interface{}{
+		"Report":      def,
+		"DB":          dbID,
+		"GeneratedAt": time.Now().Format("2006-01-02 15:04:05"),
+		"Columns":     c.columns,
+		"Rows":        c.rows,
+		"Total":       c.total,
+		"Truncated":   c.total > len(c.rows),
+	}); err != nil {
+		return nil, nil, 0, err
+	}
+	return htmlBuf.Bytes(), csvBuf.Bytes(), c.total, nil
+}
+
+// buildReportMessage 生成带HTML正文和CSV附件的MIME邮件
+func buildReportMessage(from string, to []string, subject string, html, csvData []byte, filename string) ([]byte, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		header textproto.MIMEHeader
+		body   []byte
+	}{
+		{textproto.MIMEHeader{
+			"Content-Type":              {"text/html; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"base64"},
+		}, html},
+		{textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType("text/csv", map[string]string{"charset": "UTF-8", "name": filename})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		}, csvData},
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines 按76字符一行写出base64编码
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
+
+// sendReportMail 通过配置的SMTP服务器发送邮件，配置了用户名时使用PLAIN认证
+func sendReportMail(cfg SMTPConfig, to []string, msg []byte) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(addr, auth, from.Address, to, msg)
+}
+
+// ReportScheduler 按报表定义的调度时间生成并发送报表，记录每次运行的结果
+type ReportScheduler struct {
+	mu      sync.Mutex
+	next    map[string]scheduledReport
+	running map[string]bool
+	runs    []ReportRun
+}
+
+// scheduledReport 记录调度字符串，配置修改后重新计算下次运行时间
+type scheduledReport struct {
+	schedule string
+	at       time.Time
+}
+
+var reportScheduler = NewReportScheduler()
+
+func NewReportScheduler() *ReportScheduler {
+	return &ReportScheduler{
+		next:    make(map[string]scheduledReport),
+		running: make(map[string]bool),
+	}
+}
+
+// Run 定期检查到期的报表，直到stop关闭
+func (s *ReportScheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(reportCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.tick(time.Now())
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick 启动到期的报表，并为新增或修改过调度的报表计算下次运行时间
+func (s *ReportScheduler) tick(now time.Time) {
+	cfg := getAppConfig()
+	var due []ReportDefinition
+
+	s.mu.Lock()
+	names := make(map[string]bool)
+	for _, def := range cfg.Reports {
+		names[def.Name] = true
+		sr, ok := s.next[def.Name]
+		if !ok || sr.schedule != def.Schedule {
+			at, err := nextReportRun(def.Schedule, now)
+			if err != nil {
+				slog.Error("Report schedule failed", "report", def.Name, "err", err)
+				continue
+			}
+			s.next[def.Name] = scheduledReport{schedule: def.Schedule, at: at}
+			continue
+		}
+		if !now.Before(sr.at) {
+			due = append(due, def)
+			at, _ := nextReportRun(def.Schedule, now)
+			s.next[def.Name] = scheduledReport{schedule: def.Schedule, at: at}
+		}
+	}
+	// 删除已从配置中移除的报表
+	for name := range s.next {
+		if !names[name] {
+			delete(s.next, name)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, def := range due {
+		go s.execute(def, cfg, "schedule")
+	}
+}
+
+// errReportRunning 报表上一次运行还没有结束
+var errReportRunning = errors.New("report is already running")
+
+// RunNow 立即在后台运行指定报表
+func (s *ReportScheduler) RunNow(name string) error {
+	cfg := getAppConfig()
+	for _, def := range cfg.Reports {
+		if def.Name == name {
+			s.mu.Lock()
+			running := s.running[name]
+			s.mu.Unlock()
+			if running {
+				return errReportRunning
+			}
+			go s.execute(def, cfg, "manual")
+			return nil
+		}
+	}
+	return fmt.Errorf("report %q not found", name)
+}
+
+// execute 生成并发送报表，同一报表正在运行时跳过
+func (s *ReportScheduler) execute(def ReportDefinition, cfg AppConfig, trigger string) {
+	dbID := def.DB
+	if dbID == "" {
+		dbID = cfg.DefaultDB
+	}
+	run := &ReportRun{
+		Report:     def.Name,
+		DB:         dbID,
+		Trigger:    trigger,
+		Status:     "running",
+		Recipients: def.Recipients,
+		StartedAt:  time.Now(),
+	}
+
+	s.mu.Lock()
+	if s.running[def.Name] {
+		// 跳过的运行也要留下记录
+		run.Status = "skipped"
+		run.Error = errReportRunning.Error()
+		run.FinishedAt = run.StartedAt
+		s.runs = append(s.runs, *run)
+		s.trimRuns()
+		s.mu.Unlock()
+		slog.Warn("Report is already running, skipping run", "report", def.Name, "trigger", trigger)
+		return
+	}
+	s.running[def.Name] = true
+	s.runs = append(s.runs, *run)
+	idx := len(s.runs) - 1
+	s.mu.Unlock()
+
+	err := func() error {
+		if cfg.SMTP == nil {
+			return errors.New("smtp is not configured")
+		}
+		html, csvData, rows, err := renderReport(def, dbID)
+		if err != nil {
+			return err
+		}
+		run.Rows = rows
+		subject := fmt.Sprintf("[%s] %s report, %s", dbID, def.Name, run.StartedAt.Format("2006-01-02 15:04"))
+		filename := fmt.Sprintf("%s_%s.csv", def.Name, run.StartedAt.Format("20060102_150405"))
+		msg, err := buildReportMessage(cfg.SMTP.From, def.Recipients, subject, html, csvData, filename)
+		if err != nil {
+			return err
+		}
+		return sendReportMail(*cfg.SMTP, def.Recipients, msg)
+	}()
+
+	run.FinishedAt = time.Now()
+	run.Status = "ok"
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		slog.Error("Report failed", "report", def.Name, "trigger", trigger, "err", err)
+	} else {
+		slog.Info("Report sent", "report", def.Name, "trigger", trigger, "recipients", len(def.Recipients), "elapsed", run.FinishedAt.Sub(run.StartedAt), "rows", run.Rows)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, def.Name)
+	// 运行期间记录可能已被裁剪，按开始时间重新定位
+	for i := min(idx, len(s.runs)-1); i >= 0; i-- {
+		if s.runs[i].Report == run.Report && s.runs[i].StartedAt.Equal(run.StartedAt) {
+			s.runs[i] = *run
+			break
+		}
+	}
+	s.trimRuns()
+}
+
+// trimRuns 只保留最近maxReportRuns条记录，调用方需持有s.mu
+func (s *ReportScheduler) trimRuns() {
+	if len(s.runs) > maxReportRuns {
+		s.runs = append([]ReportRun(nil), s.runs[len(s.runs)-maxReportRuns:]...)
+	}
+}
+
+// Runs 返回运行记录，最近的在前
+func (s *ReportScheduler) Runs() []ReportRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := make([]ReportRun, len(s.runs))
+	for i, r := range s.runs {
+		runs[len(s.runs)-1-i] = r
+	}
+	return runs
+}
+
+// NextRun 返回报表的下次运行时间
+func (s *ReportScheduler) NextRun(name string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sr, ok := s.next[name]
+	return sr.at, ok
+}
+
+// ReportStatus 报表定义及其下次运行时间
+type ReportStatus struct {
+	ReportDefinition
+	NextRun time.Time `json:"next_run,omitempty"`
+}
+
+func reportStatuses(cfg AppConfig) []ReportStatus {
+	statuses := make([]ReportStatus, 0, len(cfg.Reports))
+	for _, def := range cfg.Reports {
+		st := ReportStatus{ReportDefinition: def}
+		st.NextRun, _ = reportScheduler.NextRun(def.Name)
+		statuses = append(statuses, st)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// reportsHandler 报表定义和运行记录页面，POST run=<name> 立即运行
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	slog.DebugContext(r.Context(), "Handling reports request", "clientip", r.RemoteAddr, "method", r.Method)
+
+	if r.Method == http.MethodPost {
+		if err := reportScheduler.RunNow(r.FormValue("run")); err == errReportRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/reports", http.StatusSeeOther)
+		return
+	}
+
+	cfg := getAppConfig()
+	tmpl, err := template.ParseFS(templates, "templates/base.html", "templates/reports.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tmpl.Execute(w, map[string]interface{}{
+		"Reports":   reportStatuses(cfg),
+		"Runs":      reportScheduler.Runs(),
+		"DefaultDB": cfg.DefaultDB,
+		"SMTP":      cfg.SMTP,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	slog.DebugContext(r.Context(), "reportsHandler completed", "elapsed", time.Since(startTime))
+}
+
+// reportsAPIHandler 以JSON返回报表定义和运行记录
+func reportsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := getAppConfig()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reports": reportStatuses(cfg),
+		"runs":    reportScheduler.Runs(),
+	})
+}
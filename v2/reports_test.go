@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNextReportRun(t *testing.T) {
+	// 2024-05-15是星期三
+	after := time.Date(2024, 5, 15, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		schedule string
+		want     time.Time
+		wantErr  bool
+	}{
+		{"hourly", time.Date(2024, 5, 15, 11, 0, 0, 0, time.UTC), false},
+		{"every 90m", time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC), false},
+		{"daily 12:00", time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC), false},
+		{"daily 10:30", time.Date(2024, 5, 16, 10, 30, 0, 0, time.UTC), false},
+		{"DAILY 08:00", time.Date(2024, 5, 16, 8, 0, 0, 0, time.UTC), false},
+		{"weekly fri 09:00", time.Date(2024, 5, 17, 9, 0, 0, 0, time.UTC), false},
+		{"weekly monday 09:00", time.Date(2024, 5, 20, 9, 0, 0, 0, time.UTC), false},
+		{"weekly wed 10:00", time.Date(2024, 5, 22, 10, 0, 0, 0, time.UTC), false},
+		{"weekly wed 11:00", time.Date(2024, 5, 15, 11, 0, 0, 0, time.UTC), false},
+		{"", time.Time{}, true},
+		{"every 30s", time.Time{}, true},
+		{"every soon", time.Time{}, true},
+		{"daily 25:00", time.Time{}, true},
+		{"weekly someday 09:00", time.Time{}, true},
+		{"monthly 1 09:00", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := nextReportRun(tt.schedule, after)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, wantErr %v", tt.schedule, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.schedule, got, tt.want)
+		}
+	}
+}
+
+// useMockDBManager 让dbManager中的id使用sqlmock连接，测试结束后恢复
+func useMockDBManager(t *testing.T, id string) sqlmock.Sqlmock {
+	t.Helper()
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := dbManager
+	dbManager = NewDBManager()
+	dbManager.configs = []Config{{ID: id}}
+	dbManager.pools[id] = &pooledDB{id: id, db: sqlDB}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		dbManager.Close()
+		dbManager = saved
+	})
+	return mock
+}
+
+func TestRenderReport(t *testing.T) {
+	mock := useMockDBManager(t, "test")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT fid, fname, bid, fsize, status FROM bucket_files_3f")).
+		WithArgs(uint64(7), "3f").
+		WillReturnRows(sqlmock.NewRows([]string{"fid", "fname", "bid", "fsize", "status"}).
+			AddRow(9007199254740993, "a<b>.txt", 101, 2*1024*1024, "active").
+			AddRow(2, "c.txt", 102, 512*1024, "deleted"))
+
+	def := ReportDefinition{Name: "weekly-files", View: "files", Filters: map[string]string{"user": "7", "part": "3f"}}
+	html, csvData, n, err := renderReport(def, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d rows, want 2", n)
+	}
+	wantCSV := "fid,fname,bid,size_mb,status\n" +
+		"9007199254740993,a<b>.txt,101,2,active\n" +
+		"2,c.txt,102,0.5,deleted\n"
+	if string(csvData) != wantCSV {
+		t.Errorf("csv:\n%s\nwant:\n%s", csvData, wantCSV)
+	}
+	for _, want := range []string{"weekly-files", "Database: test", "2 rows", "a&lt;b&gt;.txt", "part=3f"} {
+		if !bytes.Contains(html, []byte(want)) {
+			t.Errorf("html does not contain %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestRenderReportInvalidFilters(t *testing.T) {
+	def := ReportDefinition{Name: "bad", View: "files", Filters: map[string]string{"user": "7", "part": "zz"}}
+	if _, _, _, err := renderReport(def, "test"); err == nil {
+		t.Error("expected error for invalid partition")
+	}
+}
+
+// parseReportMessage 解析邮件，返回头和各部分解码后的内容
+func parseReportMessage(t *testing.T, msg []byte) (*mail.Message, []*multipart.Part, [][]byte) {
+	t.Helper()
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("content type %q: %v", m.Header.Get("Content-Type"), err)
+	}
+	var parts []*multipart.Part
+	var bodies [][]byte
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p)
+		bodies = append(bodies, body)
+	}
+	return m, parts, bodies
+}
+
+func TestBuildReportMessage(t *testing.T) {
+	html := []byte("<p>" + strings.Repeat("报表", 100) + "</p>")
+	csvData := []byte("id,username\n1,alice\n")
+	msg, err := buildReportMessage("Reports <reports@example.com>", []string{"a@example.com", "b@example.com"},
+		"周报 users", html, csvData, "users.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(msg), "\r\n") {
+		if len(line) > 998 {
+			t.Fatalf("line longer than 998 bytes: %d", len(line))
+		}
+	}
+
+	m, parts, bodies := parseReportMessage(t, msg)
+	if got := m.Header.Get("To"); got != "a@example.com, b@example.com" {
+		t.Errorf("To = %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil || subject != "周报 users" {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	if ct := parts[0].Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("first part content type %q", ct)
+	}
+	if !bytes.Equal(bodies[0], html) {
+		t.Errorf("html body = %q", bodies[0])
+	}
+	if name := parts[1].FileName(); name != "users.csv" {
+		t.Errorf("attachment filename %q", name)
+	}
+	if !bytes.Equal(bodies[1], csvData) {
+		t.Errorf("csv attachment = %q", bodies[1])
+	}
+}
+
+// smtpStub 本地的SMTP服务器，记录收到的邮件
+type smtpStub struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	auth string // AUTH PLAIN解码后的内容
+	from string
+	rcpt []string
+	data string
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpStub) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStub) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStub) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP stub")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		s.mu.Lock()
+		switch cmd {
+		case "EHLO":
+			reply("250-localhost")
+			reply("250 AUTH PLAIN")
+		case "HELO":
+			reply("250 localhost")
+		case "AUTH":
+			fields := strings.Fields(line)
+			if b, err := base64.StdEncoding.DecodeString(fields[len(fields)-1]); err == nil {
+				s.auth = string(b)
+			}
+			reply("235 2.7.0 Authentication successful")
+		case "MAIL":
+			s.from = line[len("MAIL FROM:"):]
+			reply("250 OK")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, line[len("RCPT TO:"):])
+			reply("250 OK")
+		case "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					s.mu.Unlock()
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.data = data.String()
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			reply("250 OK")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestSendReportMail(t *testing.T) {
+	stub := newSMTPStub(t)
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: stub.port(), Username: "reports", Password: "secret", From: "Reports <reports@example.com>"}
+	to := []string{"a@example.com", "b@example.com"}
+	msg, err := buildReportMessage(cfg.From, to, "users", []byte("<p>hi</p>"), []byte("id\n1\n"), "users.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sendReportMail(cfg, to, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.auth != "\x00reports\x00secret" {
+		t.Errorf("auth = %q", stub.auth)
+	}
+	if stub.from != "<reports@example.com>" {
+		t.Errorf("MAIL FROM = %q", stub.from)
+	}
+	if strings.Join(stub.rcpt, ",") != "<a@example.com>,<b@example.com>" {
+		t.Errorf("RCPT TO = %q", stub.rcpt)
+	}
+	_, _, bodies := parseReportMessage(t, []byte(stub.data))
+	if len(bodies) != 2 || string(bodies[1]) != "id\n1\n" {
+		t.Errorf("received bodies %q", bodies)
+	}
+}
+
+func TestSendReportMailWithoutAuth(t *testing.T) {
+	stub := newSMTPStub(t)
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: stub.port(), From: "reports@example.com"}
+	if err := sendReportMail(cfg, []string{"a@example.com"}, []byte("Subject: x\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.auth != "" {
+		t.Errorf("unexpected auth %q", stub.auth)
+	}
+	if stub.data != "Subject: x\r\n\r\nbody\r\n" {
+		t.Errorf("data = %q", stub.data)
+	}
+}
+
+func TestSendReportMailConnectionRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	cfg := SMTPConfig{Host: "127.0.0.1", Port: port, From: "reports@example.com"}
+	if err := sendReportMail(cfg, []string{"a@example.com"}, []byte("x")); err == nil {
+		t.Error("expected error when the SMTP server is down")
+	}
+}
+
+func TestReportExecuteWithoutSMTP(t *testing.T) {
+	s := NewReportScheduler()
+	def := ReportDefinition{Name: "daily", View: "users", Recipients: []string{"a@example.com"}}
+	s.execute(def, AppConfig{DefaultDB: "main"}, "manual")
+	runs := s.Runs()
+	if len(runs) != 1 || runs[0].Status != "failed" || !strings.Contains(runs[0].Error, "smtp") {
+		t.Fatalf("runs = %+v, want one failed run", runs)
+	}
+}
+
+func TestReportRunWhileRunning(t *testing.T) {
+	s := NewReportScheduler()
+	s.running["daily"] = true
+	def := ReportDefinition{Name: "daily", View: "users", Recipients: []string{"a@example.com"}}
+	s.execute(def, AppConfig{DefaultDB: "main"}, "schedule")
+	runs := s.Runs()
+	if len(runs) != 1 || runs[0].Status != "skipped" || runs[0].Trigger != "schedule" {
+		t.Fatalf("runs = %+v, want one skipped run", runs)
+	}
+
+	configMu.Lock()
+	old := appConfig
+	appConfig = AppConfig{DefaultDB: "main", Reports: []ReportDefinition{def}}
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		appConfig = old
+		configMu.Unlock()
+	}()
+	if err := s.RunNow("daily"); err != errReportRunning {
+		t.Errorf("RunNow = %v, want %v", err, errReportRunning)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// readyz 检查默认库时ping的超时时间
+const readyPingTimeout = 3 * time.Second
+
+// 收到退出信号后置为true，readyz返回失败，让负载均衡摘除流量
+var shuttingDown atomic.Bool
+
+// runServer 启动HTTP服务(设置了TLSConfig时使用HTTPS)，redirect不为nil时同时启动HTTP跳转服务。
+// 收到SIGINT/SIGTERM后停止接收新请求，等待在途请求处理完(最长shutdownTimeout)，
+// 然后通知后台任务退出并关闭所有连接池
+func runServer(srv, redirect *http.Server, shutdownTimeout time.Duration, stop chan struct{}) error {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	servers := []*http.Server{srv}
+	if redirect != nil {
+		servers = append(servers, redirect)
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			if s.TLSConfig != nil {
+				// 证书由TLSConfig.GetCertificate提供
+				errCh <- s.ListenAndServeTLS("", "")
+			} else {
+				errCh <- s.ListenAndServe()
+			}
+		}(s)
+	}
+
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+		slog.Error("Server exited", "err", serveErr)
+	case <-ctx.Done():
+		slog.Info("Shutting down server, waiting for in-flight requests", "timeout", shutdownTimeout)
+	}
+
+	shuttingDown.Store(true)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	var shutdownErr error
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			shutdownErr = fmt.Errorf("graceful shutdown failed: %w", err)
+		}
+	}
+
+	close(stop)
+	dbManager.Close()
+	if serveErr != nil && !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+	if shutdownErr != nil {
+		return shutdownErr
+	}
+	slog.Info("Server stopped")
+	return nil
+}
+
+// healthzHandler 存活检查，进程能处理请求即返回成功
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler 就绪检查，默认库可以连通才返回成功
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	cfg := getAppConfig()
+	if cfg.DefaultDB == "" {
+		http.Error(w, "no default database configured", http.StatusServiceUnavailable)
+		return
+	}
+	db, release, err := dbManager.Get(r.Context(), cfg.DefaultDB)
+	if err != nil {
+		http.Error(w, "default database not reachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		http.Error(w, "default database not reachable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
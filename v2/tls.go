@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// 握手时最多每隔这么久检查一次证书文件是否更新
+const certCheckInterval = 10 * time.Second
+
+// certReloader 在证书文件被轮换后自动加载新证书，加载失败时继续使用旧证书
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load 读取证书和私钥，调用方需持有c.mu或在初始化阶段调用
+func (c *certReloader) load() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	c.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate 供tls.Config使用，必要时重新加载证书
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastCheck) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.lastCheck = time.Now()
+
+	certInfo, err1 := os.Stat(c.certFile)
+	keyInfo, err2 := os.Stat(c.keyFile)
+	if err1 != nil || err2 != nil {
+		// 文件可能正在被替换，继续使用旧证书
+		return c.cert, nil
+	}
+	if certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+
+	if err := c.load(); err != nil {
+		slog.Warn("TLS certificate reload failed, keep using current certificate", "err", err)
+		return c.cert, nil
+	}
+	slog.Info("TLS certificate reloaded", "file", c.certFile)
+	return c.cert, nil
+}
+
+// newRedirectServer 监听HTTP并将所有请求重定向到HTTPS地址
+func newRedirectServer(addr, httpsAddr string) *http.Server {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			if httpsPort != "" && httpsPort != "443" {
+				host = net.JoinHostPort(host, httpsPort)
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}